@@ -2,128 +2,841 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/fc00/go-cjdns/key"
 	"github.com/mildred/cjdnserver"
 	"github.com/mildred/simpleipc"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	// Environment variable passing the session token to the watchdog process
+	SessionEnv = "CJDNSCLIENT_SESSION"
+
+	// How long the watchdog tries to resume its session before giving up
+	ResumeTimeout    = 5 * time.Minute
+	MaxResumeBackoff = 30 * time.Second
+
+	// Ping interval when the server does not agree on one
+	WatchdogInterval = 30 * time.Second
+)
+
+type Options struct {
+	SockPath string
+	// Network namespace file to request the instance for
+	NetNs    string
+	PrivKey  string
+	KeyFile  string
+	InfoFile string
+	EnvFile  string
+	Output   string
+	// Interface options sent to the server
+	Interface string
+	MTU       int
+	Routes    stringList
+	Peers     peerList
+	// Wait for the instance to be connected before returning
+	WaitConnected bool
+	WaitTarget    string
+	WaitTimeout   time.Duration
+	// Proposed watchdog, replaced by the values agreed by the server
+	WatchdogInterval time.Duration
+	WatchdogTimeout  time.Duration
+	Limits           cjdnserver.ResourceLimits
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// List of peers in the form PUBKEY:PASSWORD@HOST:PORT
+type peerList []cjdnserver.PeerOptions
+
+func (l *peerList) String() string {
+	var peers []string
+	for _, p := range *l {
+		peers = append(peers, fmt.Sprintf("%s@%s", p.PublicKey, p.Address))
+	}
+	return strings.Join(peers, ",")
+}
+
+func (l *peerList) Set(value string) error {
+	at := strings.LastIndex(value, "@")
+	if at < 0 {
+		return fmt.Errorf("peer %#v must be in the form PUBKEY:PASSWORD@HOST:PORT", value)
+	}
+	creds := strings.SplitN(value[:at], ":", 2)
+	peer := cjdnserver.PeerOptions{
+		Address:   value[at+1:],
+		PublicKey: creds[0],
+	}
+	if len(creds) > 1 {
+		peer.Password = creds[1]
+	}
+	*l = append(*l, peer)
+	return nil
+}
+
 func main() {
-	var sockPath string
+	var opts Options
 	var watchdog bool
-	var privkey string
-	flag.StringVar(&sockPath, "sock", "/run/cjdnserver/cjdserver.sock", "Socker file path")
+	opts.NetNs = "/proc/self/ns/net"
+	flag.StringVar(&opts.SockPath, "sock", "/run/cjdnserver/cjdserver.sock", "Socker file path")
 	flag.BoolVar(&watchdog, "watchdog", false, "internal use")
-	flag.StringVar(&privkey, "privkey", "", "private key")
+	flag.StringVar(&opts.PrivKey, "privkey", "", "private key")
+	flag.StringVar(&opts.KeyFile, "key-file", "", "Read the private key from this file, generate it if missing")
+	flag.StringVar(&opts.InfoFile, "info-file", "", "Write interface details as JSON to this file (- for stdout)")
+	flag.StringVar(&opts.EnvFile, "env-file", "", "Write interface details as shell variables to this file")
+	flag.StringVar(&opts.Output, "output", "text", "Output format: text (logs only) or json (interface details on stdout)")
+	flag.StringVar(&opts.Interface, "ifname", "", "Interface name to request")
+	flag.IntVar(&opts.MTU, "mtu", 0, "Interface MTU to request")
+	flag.Var(&opts.Routes, "route", "Extra IPv6 route to add through the interface (can be repeated)")
+	flag.Var(&opts.Peers, "peer", "Extra peer PUBKEY:PASSWORD@HOST:PORT for the cjdns instance (can be repeated)")
+	flag.BoolVar(&opts.WaitConnected, "wait-connected", false, "Wait for a peer session to be established before returning")
+	flag.StringVar(&opts.WaitTarget, "wait-target", "", "With -wait-connected, wait for this cjdns address to answer instead")
+	flag.DurationVar(&opts.WaitTimeout, "wait-timeout", 30*time.Second, "Maximum time to wait with -wait-connected")
+	flag.DurationVar(&opts.WatchdogInterval, "watchdog-interval", 0, "Interval between watchdog pings to propose to the server")
+	flag.Int64Var(&opts.Limits.MemoryMax, "memory-max", 0, "Memory limit in bytes to request for cjdroute")
+	flag.Float64Var(&opts.Limits.CPUMax, "cpu-max", 0, "CPU limit to request for cjdroute, in number of CPUs")
+	flag.IntVar(&opts.Limits.PidsMax, "pids-max", 0, "Process limit to request for cjdroute")
+	flag.DurationVar(&opts.WatchdogTimeout, "watchdog-timeout", 0, "Time without watchdog pings before the server stops the instance, to propose to the server")
 	flag.Parse()
 
+	// Arguments after -- are a command to run once the interface is up
+	var command []string
+	if n := len(os.Args) - 1 - flag.NArg(); n > 0 && os.Args[n] == "--" {
+		command = flag.Args()
+	}
+
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
-	cjdnserver.CancelSignals(ctx, &wg, cancel, syscall.SIGINT, syscall.SIGTERM)
+	if command == nil {
+		cjdnserver.CancelSignals(ctx, &wg, cancel, syscall.SIGINT, syscall.SIGTERM)
+	}
 	defer cancel()
 
-	if watchdog {
+	if command != nil {
+		status, err := runCommand(ctx, &wg, &opts, command)
+		if e, ok := err.(*cjdnserver.Error); ok {
+			log.Printf("Server error: %v", e)
+			os.Exit(exitStatus(e.Code))
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(status)
+	} else if watchdog {
 		f := os.NewFile(3, "socket")
 		c, err := net.FileConn(f)
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = runWatchdog(ctx, &wg, c.(*net.UnixConn))
+		err = runWatchdog(ctx, &wg, c.(*net.UnixConn), &opts, os.Getenv(SessionEnv))
 		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
-		err := run(ctx, &wg, sockPath, privkey)
-		if err != nil {
+		var err error
+		switch flag.Arg(0) {
+		case "":
+			err = run(ctx, &wg, &opts)
+		case "attach":
+			err = parseNetNs(&opts, flag.Args(), true)
+			if err == nil {
+				err = run(ctx, &wg, &opts)
+			}
+		case "release":
+			err = parseNetNs(&opts, flag.Args(), false)
+			if err == nil {
+				err = release(&opts)
+			}
+		case "events":
+			err = parseNetNs(&opts, flag.Args(), false)
+			if err == nil {
+				err = events(&opts)
+			}
+		case "health":
+			var healthy bool
+			err = parseNetNs(&opts, flag.Args(), false)
+			if err == nil {
+				healthy, err = health(&opts)
+			}
+			if err != nil {
+				log.Print(err)
+			}
+			// Docker only defines 0 (healthy) and 1 (unhealthy)
+			if err != nil || !healthy {
+				os.Exit(1)
+			}
+		default:
+			err = fmt.Errorf("unknown command %#v", flag.Arg(0))
+		}
+		if e, ok := err.(*cjdnserver.Error); ok {
+			log.Printf("Server error: %v", e)
+			os.Exit(exitStatus(e.Code))
+		} else if err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
-func run(ctx context.Context, wg *sync.WaitGroup, sockPath, privkey string) error {
+// Parse the subcommand flags selecting a network namespace other than the
+// current one
+func parseNetNs(opts *Options, args []string, required bool) error {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	netns := fs.String("netns", "", "Network namespace file (for example /var/run/netns/NAME)")
+	pid := fs.Int("pid", 0, "Use the network namespace of this process")
+	fs.Parse(args[1:])
+
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%s: unexpected arguments %v", args[0], fs.Args())
+	} else if *netns != "" && *pid != 0 {
+		return fmt.Errorf("%s: -netns and -pid are mutually exclusive", args[0])
+	} else if *netns != "" {
+		opts.NetNs = *netns
+	} else if *pid != 0 {
+		opts.NetNs = fmt.Sprintf("/proc/%d/ns/net", *pid)
+	} else if required {
+		return fmt.Errorf("%s: -netns or -pid is required", args[0])
+	}
+	return nil
+}
+
+// Exit status for each class of server error, documented in the README
+func exitStatus(code string) int {
+	switch code {
+	case cjdnserver.ErrCodeProtocol:
+		return 3
+	case cjdnserver.ErrCodeDuplicateNamespace:
+		return 4
+	case cjdnserver.ErrCodeTunDevice:
+		return 5
+	case cjdnserver.ErrCodeCjdrouteMissing:
+		return 6
+	case cjdnserver.ErrCodeQuotaExceeded:
+		return 7
+	case cjdnserver.ErrCodeNotFound:
+		return 8
+	case cjdnserver.ErrCodeNotConnected:
+		return 9
+	default:
+		return 2
+	}
+}
+
+// Whether the client requests anything the server needs the options
+// capability to understand
+func (opts *Options) hasInterfaceOptions() bool {
+	return opts.Interface != "" || opts.MTU != 0 || len(opts.Routes) > 0 || len(opts.Peers) > 0 || opts.WaitConnected || opts.Limits != (cjdnserver.ResourceLimits{})
+}
+
+func run(ctx context.Context, wg *sync.WaitGroup, opts *Options) error {
+	cnx, reply, err := request(opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := cnx.File()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(os.Args[0], "-watchdog", "-sock", opts.SockPath, "-watchdog-interval", opts.WatchdogInterval.String())
+	cmd.Env = append(os.Environ(), SessionEnv+"="+reply.Session)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Request an interface and run the command with the watchdog in process.
+// Forward signals to the command and release the instance when it terminates.
+// Return the command exit status.
+func runCommand(ctx0 context.Context, wg *sync.WaitGroup, opts *Options, command []string) (int, error) {
+	ctx, cancel := context.WithCancel(ctx0)
+	defer cancel()
+
+	cnx, reply, err := request(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := runWatchdog(ctx, wg, cnx, opts, reply.Session)
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = os.Environ()
+	if reply.IPv6 != "" {
+		for _, v := range envVars(reply) {
+			cmd.Env = append(cmd.Env, v[0]+"="+v[1])
+		}
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	err = cmd.Start()
+	if err != nil {
+		releaseErr := release(opts)
+		if releaseErr != nil {
+			log.Print(releaseErr)
+		}
+		return 0, err
+	}
+
+	go func() {
+		for s := range signals {
+			cmd.Process.Signal(s)
+		}
+	}()
+
+	status := 0
+	err = cmd.Wait()
+	if e, ok := err.(*exec.ExitError); ok {
+		ws := e.Sys().(syscall.WaitStatus)
+		if ws.Signaled() {
+			status = 128 + int(ws.Signal())
+		} else {
+			status = ws.ExitStatus()
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	cancel()
+	err = release(opts)
+	if err != nil {
+		log.Print(err)
+	}
+	return status, nil
+}
+
+// Send the initial request and return the connection to send watchdog pings
+// on with the server response
+func request(opts *Options) (*net.UnixConn, *cjdnserver.InitialReply, error) {
 	var err error
 	var skey *key.Private = nil
 
-	if privkey != "" {
-		skey, err = key.DecodePrivate(privkey)
+	if opts.Output != "text" && opts.Output != "json" {
+		return nil, nil, fmt.Errorf("unknown output format %#v", opts.Output)
+	}
+
+	if opts.PrivKey != "" && opts.KeyFile != "" {
+		return nil, nil, fmt.Errorf("-privkey and -key-file are mutually exclusive")
+	} else if opts.KeyFile != "" {
+		skey, err = keyFile(opts.KeyFile)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+	} else if opts.PrivKey != "" {
+		skey, err = key.DecodePrivate(opts.PrivKey)
+		if err != nil {
+			return nil, nil, err
 		} else if !skey.Valid() {
-			return fmt.Errorf("invalid private key")
+			return nil, nil, fmt.Errorf("invalid private key")
 		}
 	}
 
-	cnx0, err := net.Dial("unix", sockPath)
+	cnx0, err := net.Dial("unix", opts.SockPath)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	netns, err := os.OpenFile("/proc/self/ns/net", os.O_RDONLY, 0)
+	netns, err := os.OpenFile(opts.NetNs, os.O_RDONLY, 0)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	cnx := cnx0.(*net.UnixConn)
 
 	log.Printf("Connected to server %v", cnx)
+	var require []string
+	if opts.hasInterfaceOptions() {
+		require = append(require, cjdnserver.CapOptions)
+	}
+	if opts.WaitConnected {
+		require = append(require, cjdnserver.CapWaitConnected)
+	}
+	if opts.Limits != (cjdnserver.ResourceLimits{}) {
+		require = append(require, cjdnserver.CapLimits)
+	}
+	server, err := hello(cnx, require)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	h := simpleipc.NewHeader(cjdnserver.InitialRequest, 0, []*os.File{netns})
-	if skey != nil {
+	if cjdnserver.HasCapability(server.Capabilities, cjdnserver.CapOptions) {
+		msg := &cjdnserver.InitialMessage{
+			Interface: opts.Interface,
+			MTU:       opts.MTU,
+			Routes:    opts.Routes,
+			Peers:     opts.Peers,
+		}
+		if opts.WaitConnected {
+			msg.WaitConnected = true
+			msg.WaitTarget = opts.WaitTarget
+			msg.WaitTimeout = int((opts.WaitTimeout + time.Second - 1) / time.Second)
+			log.Printf("Waiting for the instance to be connected")
+		}
+		if opts.Limits != (cjdnserver.ResourceLimits{}) {
+			msg.Limits = &opts.Limits
+		}
+		msg.WatchdogInterval = int(opts.WatchdogInterval / time.Second)
+		msg.WatchdogTimeout = int(opts.WatchdogTimeout / time.Second)
+		if skey != nil {
+			msg.PrivateKey = skey.String()
+		}
+		err = cjdnserver.WriteJSON(cnx, h, msg)
+	} else if skey != nil {
 		h.Size = uint32(len(*skey))
-	}
-	if skey != nil {
 		err = h.WriteWithPayload(cnx, skey[:])
 	} else {
 		err = h.WriteWithPayload(cnx, nil)
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := readResponse(cnx, cjdnserver.InitialResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reply cjdnserver.InitialReply
+	if len(payload) > 0 {
+		err = json.Unmarshal(payload, &reply)
+		if err != nil {
+			return nil, nil, fmt.Errorf("initial response: %v", err)
+		}
+		log.Printf("Interface %s configured with %s/%d (public key %s)", reply.Interface, reply.IPv6, reply.PrefixLen, reply.PublicKey)
+		for _, r := range reply.Rejected {
+			log.Printf("Server rejected option %s", r)
+		}
+		if reply.Connected {
+			log.Printf("Instance connected")
+		}
+		if reply.WatchdogInterval != 0 {
+			log.Printf("Watchdog pings every %ds, timeout %ds", reply.WatchdogInterval, reply.WatchdogTimeout)
+		}
+		if opts.InfoFile != "" {
+			err = writeInfo(opts.InfoFile, &reply)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if opts.Output == "json" {
+			err = writeInfo("-", &reply)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if opts.EnvFile != "" {
+			err = writeEnv(opts.EnvFile, &reply)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	opts.WatchdogInterval = time.Duration(reply.WatchdogInterval) * time.Second
+	return cnx, &reply, nil
+}
+
+func hello(cnx *net.UnixConn, require []string) (*cjdnserver.HelloReply, error) {
+	h := simpleipc.NewHeader(cjdnserver.Hello, 0, nil)
+	err := cjdnserver.WriteJSON(cnx, h, &cjdnserver.HelloMessage{
+		Version:      cjdnserver.ProtocolVersion,
+		Capabilities: cjdnserver.Capabilities,
+		Require:      require,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h = new(simpleipc.Header)
+	payload, err := h.ReadWithPayload(cnx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("server hello: %v", err)
+	} else if h.Seq != cjdnserver.HelloResponse {
+		return nil, fmt.Errorf("server hello: unexpected message %d", h.Seq)
+	}
+
+	var reply cjdnserver.HelloReply
+	err = json.Unmarshal(payload, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("server hello: %v", err)
+	} else if reply.Error != "" {
+		return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "server refused connection: %s", reply.Error)
+	}
+
+	log.Printf("Server speaks protocol version %d with capabilities %v", reply.Version, reply.Capabilities)
+	return &reply, nil
+}
+
+// Read the server response, and return the server error if it sent an
+// ErrorResponse instead of the expected message
+func readResponse(cnx *net.UnixConn, expected uint32) ([]byte, error) {
+	h := new(simpleipc.Header)
+	payload, err := h.ReadWithPayload(cnx, nil)
+	if err != nil {
+		return nil, err
+	} else if h.Seq == cjdnserver.ErrorResponse {
+		e := new(cjdnserver.Error)
+		err = json.Unmarshal(payload, e)
+		if err != nil {
+			return nil, fmt.Errorf("server error: %v", err)
+		}
+		return nil, e
+	} else if h.Seq != expected {
+		return nil, fmt.Errorf("unexpected message %d from server", h.Seq)
+	}
+	return payload, nil
+}
+
+// Connect to the server and negotiate the required capabilities, return the
+// connection and the current network namespace
+func connect(opts *Options, require []string) (*net.UnixConn, *os.File, error) {
+	cnx0, err := net.Dial("unix", opts.SockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cnx := cnx0.(*net.UnixConn)
+
+	netns, err := os.OpenFile(opts.NetNs, os.O_RDONLY, 0)
+	if err != nil {
+		cnx.Close()
+		return nil, nil, err
+	}
+
+	_, err = hello(cnx, require)
+	if err != nil {
+		cnx.Close()
+		netns.Close()
+		return nil, nil, err
+	}
+
+	return cnx, netns, nil
+}
+
+// Ask the server to tear down the instance of the current network namespace
+// and wait for it to be stopped
+func release(opts *Options) error {
+	cnx, netns, err := connect(opts, []string{cjdnserver.CapRelease})
 	if err != nil {
 		return err
 	}
+	defer cnx.Close()
+	defer netns.Close()
 
-	f, err := cnx.File()
+	h := simpleipc.NewHeader(cjdnserver.Release, 0, []*os.File{netns})
+	err = h.Write(cnx)
 	if err != nil {
 		return err
 	}
 
-	err = h.Read(cnx, nil)
+	_, err = readResponse(cnx, cjdnserver.Released)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(os.Args[0], "-watchdog")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
-	err = cmd.Start()
+	log.Printf("Released cjdns instance")
+	return nil
+}
+
+// Stream the instance events to stdout as JSON lines until the instance stops
+func events(opts *Options) error {
+	cnx, netns, err := connect(opts, []string{cjdnserver.CapEvents})
+	if err != nil {
+		return err
+	}
+	defer cnx.Close()
+	defer netns.Close()
+
+	h := simpleipc.NewHeader(cjdnserver.Subscribe, 0, []*os.File{netns})
+	err = h.Write(cnx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		payload, err := readResponse(cnx, cjdnserver.Event)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var ev cjdnserver.EventMessage
+		err = json.Unmarshal(payload, &ev)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(&ev)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Print the health of the instance to stdout as JSON and return whether it is
+// healthy
+func health(opts *Options) (bool, error) {
+	cnx, netns, err := connect(opts, []string{cjdnserver.CapHealth})
+	if err != nil {
+		return false, err
+	}
+	defer cnx.Close()
+	defer netns.Close()
+
+	h := simpleipc.NewHeader(cjdnserver.Health, 0, []*os.File{netns})
+	err = h.Write(cnx)
+	if err != nil {
+		return false, err
+	}
+
+	payload, err := readResponse(cnx, cjdnserver.HealthResponse)
+	if err != nil {
+		return false, err
+	}
+
+	var reply cjdnserver.HealthReply
+	err = json.Unmarshal(payload, &reply)
+	if err != nil {
+		return false, fmt.Errorf("health response: %v", err)
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(&reply)
+	return reply.Healthy, err
+}
+
+// Read the private key from the file, or generate a new key and write it to
+// the file if it does not exist
+func keyFile(path string) (*key.Private, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		skey := key.Generate()
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fmt.Fprintln(f, skey.String())
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		log.Printf("Generated private key in %s", path)
+		return skey, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	skey, err := key.DecodePrivate(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	} else if !skey.Valid() {
+		return nil, fmt.Errorf("%s: invalid private key", path)
+	}
+	return skey, nil
+}
+
+func writeInfo(infoFile string, reply *cjdnserver.InitialReply) error {
+	info := *reply
+	info.Session = ""
+	data, err := json.MarshalIndent(&info, "", "  ")
 	if err != nil {
 		return err
 	}
+	data = append(data, '\n')
+	if infoFile == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(infoFile, data, 0644)
+}
+
+// Environment variables describing the interface
+func envVars(reply *cjdnserver.InitialReply) [][2]string {
+	return [][2]string{
+		{"CJDNS_IPV6", reply.IPv6},
+		{"CJDNS_PUBKEY", reply.PublicKey},
+		{"CJDNS_INTERFACE", reply.Interface},
+		{"CJDNS_MTU", fmt.Sprint(reply.MTU)},
+	}
+}
+
+// Write the interface details as KEY=VALUE lines that can be sourced by a shell
+func writeEnv(envFile string, reply *cjdnserver.InitialReply) error {
+	var data []byte
+	for _, v := range envVars(reply) {
+		value := "'" + strings.Replace(v[1], "'", `'\''`, -1) + "'"
+		data = append(data, v[0]+"="+value+"\n"...)
+	}
+	return ioutil.WriteFile(envFile, data, 0644)
+}
+
+// Send watchdog pings to the server. When the connection is lost, reconnect
+// and resume the session if there is one.
+func runWatchdog(ctx context.Context, wg *sync.WaitGroup, cnx *net.UnixConn, opts *Options, session string) error {
+	interval := opts.WatchdogInterval
+	if interval <= 0 {
+		interval = WatchdogInterval
+	}
+	log.Printf("Running watchdog every %v", interval)
+	for {
+		err := pingServer(ctx, cnx, interval)
+		cnx.Close()
+		if err == nil || ctx.Err() != nil {
+			break
+		} else if session == "" {
+			return err
+		}
 
+		log.Printf("Lost connection to server: %v", err)
+		cnx, err = resume(ctx, opts, session)
+		if err != nil {
+			return err
+		} else if cnx == nil {
+			break
+		}
+	}
+
+	log.Printf("Stopped watchdog")
 	return nil
 }
 
-func runWatchdog(ctx context.Context, wg *sync.WaitGroup, cnx *net.UnixConn) error {
-	var err error
+// Send watchdog pings on the connection until it is closed. Return nil if the
+// server is shutting down the instance.
+func pingServer(ctx0 context.Context, cnx *net.UnixConn, interval time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx0)
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for {
+			h := new(simpleipc.Header)
+			payload, err := h.ReadWithPayload(cnx, nil)
+			if err != nil {
+				closed <- err
+				return
+			} else if h.Seq == cjdnserver.Event {
+				log.Printf("Event: %s", payload)
+				var ev cjdnserver.EventMessage
+				if json.Unmarshal(payload, &ev) == nil && ev.Type == cjdnserver.EventShuttingDown {
+					closed <- nil
+					return
+				}
+			}
+		}
+	}()
 
-	log.Printf("Running watchdog")
 	h := simpleipc.NewHeader(cjdnserver.WatchdogPing, 0, []*os.File{})
 	for ctx.Err() == nil {
-		timeout, _ := context.WithTimeout(ctx, 30*time.Second)
+		timeout, cancelTimeout := context.WithTimeout(ctx, interval)
 		<-timeout.Done()
-		err = h.Write(cnx)
+		cancelTimeout()
+		if ctx.Err() != nil {
+			break
+		}
+		err := h.Write(cnx)
 		if err != nil {
 			return err
 		}
 	}
 
-	log.Printf("Stopped watchdog")
-	return nil
+	if ctx0.Err() != nil {
+		return nil
+	}
+	return <-closed
+}
+
+// Reconnect to the server with exponential backoff and resume the session.
+// Return a nil connection if the context is cancelled.
+func resume(ctx context.Context, opts *Options, session string) (*net.UnixConn, error) {
+	backoff := time.Second
+	deadline := time.Now().Add(ResumeTimeout)
+	for {
+		cnx, err := resumeSession(opts, session)
+		if err == nil {
+			return cnx, nil
+		} else if _, ok := err.(*cjdnserver.Error); ok {
+			return nil, err // the server refused to resume the session
+		} else if time.Now().After(deadline) {
+			return nil, err
+		}
+
+		log.Printf("Resume session: %v (retry in %v)", err, backoff)
+		timeout, cancel := context.WithTimeout(ctx, backoff)
+		<-timeout.Done()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		backoff *= 2
+		if backoff > MaxResumeBackoff {
+			backoff = MaxResumeBackoff
+		}
+	}
+}
+
+func resumeSession(opts *Options, session string) (*net.UnixConn, error) {
+	cnx0, err := net.Dial("unix", opts.SockPath)
+	if err != nil {
+		return nil, err
+	}
+	cnx := cnx0.(*net.UnixConn)
+
+	_, err = hello(cnx, []string{cjdnserver.CapSession})
+	if err == nil {
+		h := simpleipc.NewHeader(cjdnserver.Resume, 0, nil)
+		err = cjdnserver.WriteJSON(cnx, h, &cjdnserver.ResumeMessage{Session: session})
+	}
+	if err == nil {
+		_, err = readResponse(cnx, cjdnserver.Resumed)
+	}
+	if err != nil {
+		cnx.Close()
+		return nil, err
+	}
+
+	log.Printf("Resumed session")
+	return cnx, nil
 }
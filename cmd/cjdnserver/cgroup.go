@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period used for cpu.max
+const CPUPeriod = 100000
+
+// Resource usage of an instance cgroup
+type CgroupUsage struct {
+	Path          string        `json:"path"`
+	MemoryCurrent int64         `json:"memoryCurrent"`
+	PidsCurrent   int           `json:"pidsCurrent"`
+	CPUUsage      time.Duration `json:"cpuUsage"`
+}
+
+// Path of the cgroup of the instance for the network namespace under the
+// parent cgroup
+func CgroupPath(parent string, ino uint64) string {
+	return path.Join(parent, fmt.Sprintf("cjdns-%d", ino))
+}
+
+// Create the cgroup and apply the limits. The memory, cpu and pids
+// controllers are enabled in the parent cgroup if needed.
+func MakeCgroup(logger *slog.Logger, cgroup string, limits *cjdnserver.ResourceLimits) error {
+	parent := path.Dir(cgroup)
+	err := ioutil.WriteFile(path.Join(parent, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0644)
+	if err != nil {
+		logger.Warn("Enable cgroup controllers", "cgroup", parent, "err", err)
+	}
+
+	err = os.Mkdir(cgroup, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	memoryMax, cpuMax, pidsMax := "max", "max", "max"
+	if limits.MemoryMax > 0 {
+		memoryMax = strconv.FormatInt(limits.MemoryMax, 10)
+	}
+	if limits.CPUMax > 0 {
+		cpuMax = strconv.Itoa(int(limits.CPUMax * CPUPeriod))
+	}
+	if limits.PidsMax > 0 {
+		pidsMax = strconv.Itoa(limits.PidsMax)
+	}
+
+	for file, value := range map[string]string{
+		"memory.max": memoryMax,
+		"cpu.max":    fmt.Sprintf("%s %d", cpuMax, CPUPeriod),
+		"pids.max":   pidsMax,
+	} {
+		err = ioutil.WriteFile(path.Join(cgroup, file), []byte(value), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the cgroup, it must not contain any process
+func RemoveCgroup(cgroup string) error {
+	return os.Remove(cgroup)
+}
+
+func GetCgroupUsage(cgroup string) (*CgroupUsage, error) {
+	usage := &CgroupUsage{Path: cgroup}
+
+	data, err := ioutil.ReadFile(path.Join(cgroup, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	usage.MemoryCurrent, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(path.Join(cgroup, "pids.current"))
+	if err != nil {
+		return nil, err
+	}
+	usage.PidsCurrent, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(path.Join(cgroup, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		cols := strings.Fields(line)
+		if len(cols) == 2 && cols[0] == "usage_usec" {
+			usec, err := strconv.ParseInt(cols[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			usage.CPUUsage = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	return usage, nil
+}
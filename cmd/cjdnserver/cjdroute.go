@@ -3,27 +3,42 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/fc00/go-cjdns/key"
-	"log"
+	"github.com/mildred/cjdnserver"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
-func Genconf(cjdroute, tunsockpath, adminaddr string, peer *Peer, skey *key.Private) (string, string, string, error) {
+// Generated cjdroute configuration
+type Conf struct {
+	Data          string
+	IPv6          string
+	PublicKey     string
+	PrivateKey    string
+	AdminPassword string
+}
+
+func Genconf(cjdroute, tunsockpath, adminaddr string, upstream []Peer, extraPeers []Peer, skey *key.Private) (*Conf, error) {
+	if _, err := exec.LookPath(cjdroute); err != nil {
+		return nil, cjdnserver.NewError(cjdnserver.ErrCodeCjdrouteMissing, "Cannot find cjdroute: %v", err)
+	}
+
 	cmd := exec.Command("sh", "-xc", cjdroute+" --genconf --no-eth | "+cjdroute+" --cleanconf")
 
 	out, err := cmd.Output()
 	if err != nil {
 		if e, ok := err.(*exec.ExitError); ok {
-			log.Print(string(e.Stderr))
+			return nil, fmt.Errorf("cjdroute --genconf: %v: %s", err, bytes.TrimSpace(e.Stderr))
 		}
-		return "", "", "", err
+		return nil, err
 	}
 
 	var config map[string]interface{} = map[string]interface{}{}
 	err = json.Unmarshal(out, &config)
 	if err != nil {
-		return "", "", "", err
+		return nil, err
 	}
 
 	if skey != nil {
@@ -32,14 +47,7 @@ func Genconf(cjdroute, tunsockpath, adminaddr string, peer *Peer, skey *key.Priv
 		config["ipv6"] = skey.Pubkey().IP().String()
 	}
 
-	interfaces_udp_0 := config["interfaces"].(map[string]interface{})["UDPInterface"].([]interface{})[0].(map[string]interface{})
-	interfaces_udp_0_connectTo := interfaces_udp_0["connectTo"].(map[string]interface{})
-	if peer.Address != "" {
-		interfaces_udp_0_connectTo[peer.Address] = map[string]interface{}{
-			"password":  peer.Password,
-			"publicKey": peer.Pubkey,
-		}
-	}
+	setConnectTo(config, append(append([]Peer{}, upstream...), extraPeers...), nil)
 	//logging := config["logging"].(map[string]interface{})
 	//logging["logTo"] = "stdout"
 	admin := config["admin"].(map[string]interface{})
@@ -49,16 +57,75 @@ func Genconf(cjdroute, tunsockpath, adminaddr string, peer *Peer, skey *key.Priv
 	router_interface["tunfd"] = "normal"
 	router_interface["tunDevice"] = tunsockpath
 	ipv6 := config["ipv6"].(string)
+	pubkey := config["publicKey"].(string)
+	privkey := config["privateKey"].(string)
 
 	data, err := json.MarshalIndent(config, "", " ")
-	return string(data), ipv6, adminpass, err
+	if err != nil {
+		return nil, err
+	}
+	return &Conf{
+		Data:          string(data),
+		IPv6:          ipv6,
+		PublicKey:     pubkey,
+		PrivateKey:    privkey,
+		AdminPassword: adminpass,
+	}, nil
 }
 
-func Start(cjdroute, config string) (*os.Process, error) {
+// Add the peers to connect to in the first UDP interface of the cjdroute
+// configuration, and remove the stale ones
+func setConnectTo(config map[string]interface{}, peers, stale []Peer) {
+	interfaces_udp_0 := config["interfaces"].(map[string]interface{})["UDPInterface"].([]interface{})[0].(map[string]interface{})
+	interfaces_udp_0_connectTo := interfaces_udp_0["connectTo"].(map[string]interface{})
+	for _, p := range stale {
+		delete(interfaces_udp_0_connectTo, p.Address)
+	}
+	for _, p := range peers {
+		interfaces_udp_0_connectTo[p.Address] = map[string]interface{}{
+			"password":  p.Password,
+			"publicKey": p.Pubkey,
+		}
+	}
+}
+
+// Change the peers in the configuration data generated by Genconf
+func updateConnectTo(data string, peers, stale []Peer) (string, error) {
+	var config map[string]interface{} = map[string]interface{}{}
+	err := json.Unmarshal([]byte(data), &config)
+	if err != nil {
+		return "", err
+	}
+	setConnectTo(config, peers, stale)
+	out, err := json.MarshalIndent(config, "", " ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Start cjdroute with the given configuration. If cgroup is not empty or the
+// sandbox is enabled, cjdroute is started through the sandbox subcommand that
+// moves it to the cgroup and drops privileges before it is executed, so its
+// children are confined as well.
+func Start(cjdroute, config, cgroup string, sandbox *Sandbox, output *os.File) (*os.Process, error) {
 	cmd := exec.Command(cjdroute, "--nobg")
+	if cgroup != "" || sandbox.Enabled() {
+		var err error
+		cmd, err = sandbox.Command(cgroup, cjdroute, "--nobg")
+		if err != nil {
+			return nil, err
+		}
+	}
 	cmd.Stdin = bytes.NewReader([]byte(config))
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if output != nil {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+	// Do not forward terminal signals sent to the server process group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	err := cmd.Start()
 	return cmd.Process, err
 }
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration written like "1m30s" in the configuration file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Comma separated list of strings on the command line
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, s := range strings.Split(value, ",") {
+		if s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// Server configuration, read from the configuration file given with -config
+// and overridden by the command line flags
+type Config struct {
+	Listen    ListenConfig    `json:"listen"`
+	Cjdroute  CjdrouteConfig  `json:"cjdroute"`
+	Peer      Peer            `json:"peer"`
+	Peers     []Peer          `json:"peers"`
+	PeersFile string          `json:"peersFile"`
+	Detect    DetectConfig    `json:"detect"`
+	Interface InterfaceConfig `json:"interface"`
+	Restart   RestartConfig   `json:"restart"`
+	Stop      StopConfig      `json:"stop"`
+	Quotas    QuotaConfig     `json:"quotas"`
+	StateDir  string          `json:"stateDir"`
+	Log       LogConfig       `json:"log"`
+}
+
+type ListenConfig struct {
+	Sock    string `json:"sock"`
+	Perms   string `json:"perms"`
+	CtlSock string `json:"ctlSock"`
+}
+
+type CjdrouteConfig struct {
+	Path         string `json:"path"`
+	User         string `json:"user"`
+	Group        string `json:"group"`
+	Seccomp      string `json:"seccomp"`
+	CgroupParent string `json:"cgroupParent"`
+}
+
+// Which processes get a cjdns instance for their network namespace
+type DetectConfig struct {
+	Enabled bool `json:"enabled"`
+	// Command names (as in /proc/PID/comm) of the processes to leave alone
+	IgnoreCommands []string `json:"ignoreCommands"`
+}
+
+// Interface defaults and the limits of the options clients can request
+type InterfaceConfig struct {
+	Name               string   `json:"name"`
+	MTU                int      `json:"mtu"`
+	AllowName          bool     `json:"allowName"`
+	MinMTU             int      `json:"minMTU"`
+	MaxMTU             int      `json:"maxMTU"`
+	MaxRoutes          int      `json:"maxRoutes"`
+	MaxPeers           int      `json:"maxPeers"`
+	MaxWaitConnected   Duration `json:"maxWaitConnected"`
+	MinWatchdogTimeout Duration `json:"minWatchdogTimeout"`
+	MaxWatchdogTimeout Duration `json:"maxWatchdogTimeout"`
+}
+
+type RestartConfig struct {
+	Mode       string   `json:"mode"`
+	MinBackoff Duration `json:"minBackoff"`
+	MaxBackoff Duration `json:"maxBackoff"`
+	Max        int      `json:"max"`
+	Window     Duration `json:"window"`
+}
+
+type StopConfig struct {
+	ExitTimeout  Duration `json:"exitTimeout"`
+	TermTimeout  Duration `json:"termTimeout"`
+	KillTimeout  Duration `json:"killTimeout"`
+	DrainTimeout Duration `json:"drainTimeout"`
+}
+
+type QuotaConfig struct {
+	MaxInstances int     `json:"maxInstances"`
+	MemoryMax    int64   `json:"memoryMax"`
+	CPUMax       float64 `json:"cpuMax"`
+	PidsMax      int     `json:"pidsMax"`
+}
+
+type LogConfig struct {
+	Format  string `json:"format"`
+	Level   string `json:"level"`
+	Dir     string `json:"dir"`
+	MaxSize int64  `json:"maxSize"`
+	Backups int    `json:"backups"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			Sock:    "/run/cjdnserver/cjdserver.sock",
+			Perms:   "0755",
+			CtlSock: DefaultCtlSock,
+		},
+		Cjdroute: CjdrouteConfig{
+			Path: "cjdroute",
+		},
+		Peer: Peer{
+			Address: "0.0.0.0:33097",
+		},
+		Interface: InterfaceConfig{
+			Name:               InterfaceName,
+			MTU:                InterfaceMTU,
+			AllowName:          true,
+			MinMTU:             1280,
+			MaxMTU:             InterfaceMTU,
+			MaxRoutes:          8,
+			MaxWaitConnected:   Duration(45 * time.Second),
+			MinWatchdogTimeout: Duration(10 * time.Second),
+			MaxWatchdogTimeout: Duration(10 * time.Minute),
+		},
+		Restart: RestartConfig{
+			Mode:       RestartAlways,
+			MinBackoff: Duration(time.Second),
+			MaxBackoff: Duration(5 * time.Minute),
+			Max:        5,
+			Window:     Duration(10 * time.Minute),
+		},
+		Stop: StopConfig{
+			ExitTimeout:  Duration(5 * time.Second),
+			TermTimeout:  Duration(10 * time.Second),
+			KillTimeout:  Duration(5 * time.Second),
+			DrainTimeout: Duration(30 * time.Second),
+		},
+		Log: LogConfig{
+			Format:  "text",
+			Level:   "info",
+			MaxSize: 1024 * 1024,
+			Backups: 3,
+		},
+	}
+}
+
+// Register the command line flags, with the current values as defaults
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.Sock, "sock", c.Listen.Sock, "Socket file path")
+	fs.StringVar(&c.Listen.Perms, "perms", c.Listen.Perms, "Socket permissions")
+	fs.StringVar(&c.Listen.CtlSock, "ctl-sock", c.Listen.CtlSock, "Control socket file path (empty to disable)")
+	fs.StringVar(&c.Cjdroute.Path, "cjdroute", c.Cjdroute.Path, "cjdroute executable")
+	fs.StringVar(&c.Peer.Address, "peer-address", c.Peer.Address, "Peer address to connect to over UDP")
+	fs.StringVar(&c.Peer.Password, "peer-password", c.Peer.Password, "Peer password")
+	fs.StringVar(&c.Peer.Pubkey, "peer-pubkey", c.Peer.Pubkey, "Peer public key")
+	fs.StringVar(&c.PeersFile, "peers-file", c.PeersFile, "JSON file with more upstream peers, read again on SIGHUP")
+	fs.BoolVar(&c.Detect.Enabled, "detect-netns", c.Detect.Enabled, "Detect network namespace and instanciate cjdns for them")
+	fs.Var((*stringList)(&c.Detect.IgnoreCommands), "detect-ignore", "Comma separated command names of the processes to ignore with -detect-netns")
+	fs.IntVar(&c.Quotas.MaxInstances, "max-instances", c.Quotas.MaxInstances, "Maximum number of cjdns instances (0 for unlimited)")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "Persist instances in this directory and keep them running across server restarts")
+	fs.StringVar(&c.Interface.Name, "interface-name", c.Interface.Name, "Default interface name")
+	fs.IntVar(&c.Interface.MTU, "interface-mtu", c.Interface.MTU, "Default interface MTU")
+	fs.BoolVar(&c.Interface.AllowName, "allow-interface-name", c.Interface.AllowName, "Allow clients to choose the interface name")
+	fs.IntVar(&c.Interface.MinMTU, "min-mtu", c.Interface.MinMTU, "Minimum interface MTU clients can request")
+	fs.IntVar(&c.Interface.MaxMTU, "max-mtu", c.Interface.MaxMTU, "Maximum interface MTU clients can request")
+	fs.IntVar(&c.Interface.MaxRoutes, "max-routes", c.Interface.MaxRoutes, "Maximum number of extra routes clients can request")
+	fs.IntVar(&c.Interface.MaxPeers, "max-peers", c.Interface.MaxPeers, "Maximum number of extra peers clients can request")
+	fs.DurationVar((*time.Duration)(&c.Interface.MaxWaitConnected), "max-wait-connected", time.Duration(c.Interface.MaxWaitConnected), "Maximum time clients can wait for connectivity before the initial response (0 to disable)")
+	fs.DurationVar((*time.Duration)(&c.Interface.MinWatchdogTimeout), "min-watchdog-timeout", time.Duration(c.Interface.MinWatchdogTimeout), "Minimum watchdog timeout clients can request")
+	fs.DurationVar((*time.Duration)(&c.Interface.MaxWatchdogTimeout), "max-watchdog-timeout", time.Duration(c.Interface.MaxWatchdogTimeout), "Maximum watchdog timeout clients can request")
+	fs.StringVar(&c.Cjdroute.User, "cjdroute-user", c.Cjdroute.User, "Run cjdroute as this user")
+	fs.StringVar(&c.Cjdroute.Group, "cjdroute-group", c.Cjdroute.Group, "Run cjdroute as this group")
+	fs.StringVar(&c.Cjdroute.Seccomp, "cjdroute-seccomp", c.Cjdroute.Seccomp, "Load this seccomp BPF program (as exported by seccomp_export_bpf) before executing cjdroute")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Server log format: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Server log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Dir, "log-dir", c.Log.Dir, "Write the output of each cjdroute instance to a file in this directory instead of memory")
+	fs.Int64Var(&c.Log.MaxSize, "log-max-size", c.Log.MaxSize, "Size of the instance log files before rotation, or of the in memory logs")
+	fs.IntVar(&c.Log.Backups, "log-backups", c.Log.Backups, "Number of rotated instance log files to keep")
+	fs.StringVar(&c.Cjdroute.CgroupParent, "cgroup-parent", c.Cjdroute.CgroupParent, "Run each cjdroute instance in a sub-cgroup of this cgroup v2 directory")
+	fs.Int64Var(&c.Quotas.MemoryMax, "memory-max", c.Quotas.MemoryMax, "Default and maximum memory per cjdroute instance in bytes, with -cgroup-parent (0 for unlimited)")
+	fs.Float64Var(&c.Quotas.CPUMax, "cpu-max", c.Quotas.CPUMax, "Default and maximum CPUs per cjdroute instance, with -cgroup-parent (0 for unlimited)")
+	fs.IntVar(&c.Quotas.PidsMax, "pids-max", c.Quotas.PidsMax, "Default and maximum number of processes per cjdroute instance, with -cgroup-parent (0 for unlimited)")
+	fs.StringVar(&c.Restart.Mode, "restart", c.Restart.Mode, "When to restart cjdroute: always, on-failure or never")
+	fs.DurationVar((*time.Duration)(&c.Restart.MinBackoff), "restart-min-backoff", time.Duration(c.Restart.MinBackoff), "Delay before restarting cjdroute, doubled for each restart in the window")
+	fs.DurationVar((*time.Duration)(&c.Restart.MaxBackoff), "restart-max-backoff", time.Duration(c.Restart.MaxBackoff), "Maximum delay before restarting cjdroute")
+	fs.IntVar(&c.Restart.Max, "restart-max", c.Restart.Max, "Maximum number of restarts within the window before the instance fails (0 for unlimited)")
+	fs.DurationVar((*time.Duration)(&c.Restart.Window), "restart-window", time.Duration(c.Restart.Window), "Window for -restart-max")
+	fs.DurationVar((*time.Duration)(&c.Stop.ExitTimeout), "stop-exit-timeout", time.Duration(c.Stop.ExitTimeout), "Time to wait for cjdroute to exit after Core_exit (0 to skip)")
+	fs.DurationVar((*time.Duration)(&c.Stop.TermTimeout), "stop-term-timeout", time.Duration(c.Stop.TermTimeout), "Time to wait for cjdroute to exit after SIGTERM (0 to skip)")
+	fs.DurationVar((*time.Duration)(&c.Stop.KillTimeout), "stop-kill-timeout", time.Duration(c.Stop.KillTimeout), "Time to wait for cjdroute to exit after SIGKILL")
+	fs.DurationVar((*time.Duration)(&c.Stop.DrainTimeout), "drain-timeout", time.Duration(c.Stop.DrainTimeout), "Time to wait for all instances to stop when shutting down")
+}
+
+// Read the configuration file over the current values. Comments are allowed
+// and unknown keys are an error.
+func (c *Config) Load(file string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	data, err := stripComments(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// Parse the command line and load the configuration file given with -config.
+// The flags set on the command line override the file values. Return the
+// configuration and the configuration file name.
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, string, error) {
+	var configFile string
+	cfg := DefaultConfig()
+	fs.StringVar(&configFile, "config", "", "JSON configuration file, overridden by the command line flags")
+	cfg.Flags(fs)
+	fs.Parse(args)
+	if configFile == "" {
+		return cfg, "", nil
+	}
+
+	fileCfg := DefaultConfig()
+	err := fileCfg.Load(configFile)
+	if err != nil {
+		return nil, "", err
+	}
+	override := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	fileCfg.Flags(override)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = override.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return fileCfg, configFile, nil
+}
+
+func validPeer(p *Peer) error {
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return fmt.Errorf("invalid peer address %#v", p.Address)
+	} else if p.Pubkey == "" {
+		return fmt.Errorf("peer %s has no public key", p.Address)
+	}
+	return nil
+}
+
+// Check the configuration, return all the errors found
+func (c *Config) Validate() error {
+	var errs []string
+	if _, err := strconv.ParseUint(c.Listen.Perms, 8, 32); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid socket permissions %#v", c.Listen.Perms))
+	}
+	if c.Peer.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Peer.Address); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid peer address %#v", c.Peer.Address))
+		}
+	}
+	for i := range c.Peers {
+		if err := validPeer(&c.Peers[i]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.PeersFile != "" {
+		if _, err := readPeersFile(c.PeersFile); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := validInterfaceName(c.Interface.Name); err != nil {
+		errs = append(errs, fmt.Sprintf("interface name: %v", err))
+	}
+	if c.Interface.MinMTU > c.Interface.MaxMTU {
+		errs = append(errs, fmt.Sprintf("minimum MTU %d is above the maximum %d", c.Interface.MinMTU, c.Interface.MaxMTU))
+	} else if c.Interface.MTU < c.Interface.MinMTU || c.Interface.MTU > c.Interface.MaxMTU {
+		errs = append(errs, fmt.Sprintf("interface MTU %d is not between %d and %d", c.Interface.MTU, c.Interface.MinMTU, c.Interface.MaxMTU))
+	}
+	if c.Interface.MinWatchdogTimeout > c.Interface.MaxWatchdogTimeout {
+		errs = append(errs, fmt.Sprintf("minimum watchdog timeout %v is above the maximum %v", time.Duration(c.Interface.MinWatchdogTimeout), time.Duration(c.Interface.MaxWatchdogTimeout)))
+	}
+	if err := c.RestartPolicy().Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := c.StopPolicy().Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.Cjdroute.CgroupParent == "" && (c.Quotas.MemoryMax != 0 || c.Quotas.CPUMax != 0 || c.Quotas.PidsMax != 0) {
+		errs = append(errs, "memory, cpu and pids quotas need a cgroup parent")
+	}
+	if c.Stop.DrainTimeout <= 0 {
+		errs = append(errs, fmt.Sprintf("invalid drain timeout %v", time.Duration(c.Stop.DrainTimeout)))
+	}
+	if _, err := c.Sandbox(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := newLogHandler(c.Log.Format, c.Log.Level); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func (c *Config) Policy() *Policy {
+	return &Policy{
+		InterfaceName:      c.Interface.Name,
+		InterfaceMTU:       c.Interface.MTU,
+		AllowInterfaceName: c.Interface.AllowName,
+		MinMTU:             c.Interface.MinMTU,
+		MaxMTU:             c.Interface.MaxMTU,
+		MaxRoutes:          c.Interface.MaxRoutes,
+		MaxPeers:           c.Interface.MaxPeers,
+		MaxWaitConnected:   time.Duration(c.Interface.MaxWaitConnected),
+		MinWatchdogTimeout: time.Duration(c.Interface.MinWatchdogTimeout),
+		MaxWatchdogTimeout: time.Duration(c.Interface.MaxWatchdogTimeout),
+		Limits: cjdnserver.ResourceLimits{
+			MemoryMax: c.Quotas.MemoryMax,
+			CPUMax:    c.Quotas.CPUMax,
+			PidsMax:   c.Quotas.PidsMax,
+		},
+		EnforceLimits: c.Cjdroute.CgroupParent != "",
+	}
+}
+
+func (c *Config) RestartPolicy() *RestartPolicy {
+	return &RestartPolicy{
+		Mode:        c.Restart.Mode,
+		MinBackoff:  time.Duration(c.Restart.MinBackoff),
+		MaxBackoff:  time.Duration(c.Restart.MaxBackoff),
+		MaxRestarts: c.Restart.Max,
+		Window:      time.Duration(c.Restart.Window),
+	}
+}
+
+func (c *Config) StopPolicy() *StopPolicy {
+	return &StopPolicy{
+		ExitTimeout: time.Duration(c.Stop.ExitTimeout),
+		TermTimeout: time.Duration(c.Stop.TermTimeout),
+		KillTimeout: time.Duration(c.Stop.KillTimeout),
+	}
+}
+
+func (c *Config) Sandbox() (*Sandbox, error) {
+	uid, gid, err := lookupIds(c.Cjdroute.User, c.Cjdroute.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &Sandbox{Uid: uid, Gid: gid, Seccomp: c.Cjdroute.Seccomp}, nil
+}
+
+// Implement the check-config subcommand: validate the configuration file and
+// flags and print the resulting configuration
+func runCheckConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-config [-config FILE] [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	cfg, _, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+const RedactedSecret = "<redacted>"
+
+// Copy of the configuration with the peer passwords hidden, to be printed
+func (c *Config) Redacted() *Config {
+	res := *c
+	if res.Peer.Password != "" {
+		res.Peer.Password = RedactedSecret
+	}
+	res.Peers = make([]Peer, len(c.Peers))
+	for i, p := range c.Peers {
+		if p.Password != "" {
+			p.Password = RedactedSecret
+		}
+		res.Peers[i] = p
+	}
+	return &res
+}
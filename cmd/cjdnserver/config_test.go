@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "cjdnserver-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := path.Join(dir, "cjdnserver.json")
+	err = ioutil.WriteFile(file, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseConfigFlagsOverrideFile(t *testing.T) {
+	file := writeConfig(t, `{
+		// comments are allowed
+		"restart": {"mode": "on-failure", "minBackoff": "3s", "maxBackoff": "1m"},
+		"detect": {"enabled": true, "ignoreCommands": ["pause", "tini"]},
+		"quotas": {"maxInstances": 7}
+	}`)
+
+	fs := flag.NewFlagSet("cjdnserver", flag.ContinueOnError)
+	cfg, configFile, err := parseConfig(fs, []string{"-config", file, "-restart-min-backoff", "5s", "-detect-ignore", "sleep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configFile != file {
+		t.Errorf("config file %#v, expected %#v", configFile, file)
+	}
+
+	// Flags win
+	if time.Duration(cfg.Restart.MinBackoff) != 5*time.Second {
+		t.Errorf("restart min backoff %v, expected 5s", time.Duration(cfg.Restart.MinBackoff))
+	}
+	if !reflect.DeepEqual(cfg.Detect.IgnoreCommands, []string{"sleep"}) {
+		t.Errorf("detect ignore %v, expected [sleep]", cfg.Detect.IgnoreCommands)
+	}
+
+	// Unset flags keep the file values
+	if cfg.Restart.Mode != RestartOnFailure {
+		t.Errorf("restart mode %#v, expected %#v", cfg.Restart.Mode, RestartOnFailure)
+	}
+	if time.Duration(cfg.Restart.MaxBackoff) != time.Minute {
+		t.Errorf("restart max backoff %v, expected 1m", time.Duration(cfg.Restart.MaxBackoff))
+	}
+	if !cfg.Detect.Enabled {
+		t.Errorf("detect not enabled")
+	}
+	if cfg.Quotas.MaxInstances != 7 {
+		t.Errorf("max instances %d, expected 7", cfg.Quotas.MaxInstances)
+	}
+
+	// Neither in the file nor in the flags: the default value
+	if time.Duration(cfg.Restart.Window) != 10*time.Minute {
+		t.Errorf("restart window %v, expected the default 10m", time.Duration(cfg.Restart.Window))
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	file := writeConfig(t, `{"restart": {"minBackof": "3s"}}`)
+	err := DefaultConfig().Load(file)
+	if err == nil || !strings.Contains(err.Error(), "minBackof") {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+
+	fs := flag.NewFlagSet("cjdnserver", flag.ContinueOnError)
+	_, _, err = parseConfig(fs, []string{"-config", file})
+	if err == nil {
+		t.Errorf("parseConfig accepted an unknown field")
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Peer = Peer{Address: "0.0.0.0:33097", Password: "upstream secret"}
+	cfg.Peers = []Peer{{Address: "192.0.2.1:1234", Password: "peer secret", Pubkey: "peer.k"}, {Address: "192.0.2.2:1234"}}
+
+	data, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"upstream secret", "peer secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("printed configuration contains %#v: %s", secret, data)
+		}
+	}
+	if cfg.Peer.Password != "upstream secret" || cfg.Peers[0].Password != "peer secret" {
+		t.Errorf("the configuration was modified: %#v %#v", cfg.Peer, cfg.Peers)
+	}
+	if p := cfg.Redacted().Peers[1]; p.Password != "" {
+		t.Errorf("empty password redacted as %#v", p.Password)
+	}
+}
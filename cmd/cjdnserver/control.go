@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"github.com/mildred/simpleipc"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DefaultCtlSock = "/run/cjdnserver/control.sock"
+)
+
+// Messages on the control socket
+const (
+	ControlRequest  = 0
+	ControlResponse = 1
+	// Chunk of instance output, sent before the ControlResponse of the logs
+	// command
+	ControlLog = 2
+)
+
+// Control commands
+const (
+	CtlList    = "list"
+	CtlInspect = "inspect"
+	CtlRestart = "restart"
+	CtlKill    = "kill"
+	CtlLogs    = "logs"
+	CtlReload  = "reload"
+)
+
+// Payload of the ControlRequest message
+type CtlRequest struct {
+	Command string `json:"command"`
+	// Instance network namespace inode, IPv6 address or public key
+	Instance string `json:"instance,omitempty"`
+	// Keep sending the instance output until it stops (logs command)
+	Follow bool `json:"follow,omitempty"`
+}
+
+// Payload of the ControlResponse message
+type CtlResponse struct {
+	Error     string            `json:"error,omitempty"`
+	Instances []*InstanceStatus `json:"instances,omitempty"`
+	// Upstream peers after the reload command
+	Peers []cjdnserver.PeerInfo `json:"peers,omitempty"`
+}
+
+type InstanceStatus struct {
+	Ino         uint64        `json:"ino"`
+	Pid         int           `json:"pid"`
+	State       string        `json:"state"`
+	IPv6        string        `json:"ipv6"`
+	PublicKey   string        `json:"publicKey"`
+	AdminPort   int           `json:"adminPort"`
+	Started     time.Time     `json:"started"`
+	Uptime      time.Duration `json:"uptime"`
+	Restarts    int           `json:"restarts"`
+	Peers       int           `json:"peers"`
+	Established int           `json:"established"`
+	LastPing    time.Time     `json:"lastPing"`
+	Cgroup      *CgroupUsage  `json:"cgroup,omitempty"`
+}
+
+func (inst *Instance) Status() *InstanceStatus {
+	inst.Lock()
+	st := &InstanceStatus{
+		Ino:         inst.Ino,
+		Pid:         inst.Pid,
+		State:       inst.stateName(),
+		IPv6:        inst.IPv6,
+		PublicKey:   inst.PublicKey,
+		AdminPort:   inst.AdminPort,
+		Started:     inst.Started,
+		Uptime:      time.Since(inst.Started),
+		Restarts:    inst.Restarts,
+		Peers:       inst.peers,
+		Established: inst.established,
+		LastPing:    inst.lastPing,
+	}
+	cgroup := inst.Cgroup
+	inst.Unlock()
+
+	if cgroup != "" {
+		usage, err := GetCgroupUsage(cgroup)
+		if err != nil {
+			inst.Logger().Warn("Cgroup usage", "cgroup", cgroup, "err", err)
+		} else {
+			st.Cgroup = usage
+		}
+	}
+	return st
+}
+
+// Healthy when cjdroute is running and, if peers are configured, the peer stats
+// were read and show an established session
+func (inst *Instance) Health() *cjdnserver.HealthReply {
+	inst.Lock()
+	defer inst.Unlock()
+	running := inst.Pid != 0
+	configured := len(inst.upstream) + len(inst.Settings.Peers)
+	connected := configured == 0 || (inst.peerStats && inst.established > 0)
+	return &cjdnserver.HealthReply{
+		Healthy:     running && connected,
+		Running:     running,
+		State:       inst.stateName(),
+		Pid:         inst.Pid,
+		IPv6:        inst.IPv6,
+		Restarts:    inst.Restarts,
+		Peers:       inst.peers,
+		Established: inst.established,
+		LastPing:    inst.lastPing,
+	}
+}
+
+// Ask the instance to restart cjdroute
+func (inst *Instance) Restart() {
+	select {
+	case inst.restart <- struct{}{}:
+	default: // restart already pending
+	}
+}
+
+func (cl *ClientList) List() []*Instance {
+	cl.Lock()
+	defer cl.Unlock()
+	var list []*Instance
+	for _, inst := range cl.Ns {
+		list = append(list, inst)
+	}
+	return list
+}
+
+// Find an instance by network namespace inode, IPv6 address or public key
+func (cl *ClientList) Find(id string) *Instance {
+	if ino, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return cl.Get(ino)
+	}
+	for _, inst := range cl.List() {
+		st := inst.Status()
+		if st.IPv6 == id || st.PublicKey == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// Serve the control socket until the context is cancelled. The handlers are
+// tracked in the wait group so the drain covers the requests in flight.
+func serveControl(ctx context.Context, wg *sync.WaitGroup, l net.Listener, srv *Server) {
+	var backoff acceptBackoff
+	for ctx.Err() == nil {
+		cnx, err := l.Accept()
+		if err != nil {
+			backoff.Wait(ctx, "Accept control connection", err)
+			continue
+		}
+		backoff.Reset()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cnx.Close()
+			err := handleControl(ctx, cnx.(*net.UnixConn), srv)
+			if err != nil {
+				slog.Error("Control request failed", "err", err)
+			}
+		}()
+	}
+}
+
+func handleControl(ctx context.Context, cnx *net.UnixConn, srv *Server) error {
+	h := new(simpleipc.Header)
+	payload, err := h.ReadWithPayload(cnx, nil)
+	if err != nil {
+		return err
+	} else if h.Seq != ControlRequest {
+		return fmt.Errorf("Received unknown message %d on control socket", h.Seq)
+	}
+
+	var req CtlRequest
+	var res CtlResponse
+	err = json.Unmarshal(payload, &req)
+	if err != nil {
+		res.Error = err.Error()
+	} else if req.Command == CtlLogs {
+		err = sendLogs(ctx, cnx, &req, srv.Clients)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	} else {
+		err = control(ctx, &req, &res, srv)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	h = simpleipc.NewHeader(ControlResponse, 0, nil)
+	return cjdnserver.WriteJSON(cnx, h, &res)
+}
+
+func control(ctx context.Context, req *CtlRequest, res *CtlResponse, srv *Server) error {
+	clientList := srv.Clients
+	if req.Command == CtlReload {
+		slog.Info("Control: reload")
+		err := srv.Reload()
+		if err != nil {
+			return err
+		}
+		for _, p := range srv.UpstreamPeers() {
+			res.Peers = append(res.Peers, cjdnserver.PeerInfo{Address: p.Address, PublicKey: p.Pubkey})
+		}
+		return nil
+	} else if req.Command == CtlList {
+		for _, inst := range clientList.List() {
+			res.Instances = append(res.Instances, inst.Status())
+		}
+		return nil
+	}
+
+	inst := clientList.Find(req.Instance)
+	if inst == nil {
+		return fmt.Errorf("No instance %#v", req.Instance)
+	}
+
+	switch req.Command {
+	case CtlInspect:
+	case CtlRestart:
+		inst.Logger().Info("Control: restart")
+		inst.Restart()
+	case CtlKill:
+		inst.Logger().Info("Control: kill")
+		inst.Cancel()
+		select {
+		case <-inst.Done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		return fmt.Errorf("Unknown command %#v", req.Command)
+	}
+	res.Instances = append(res.Instances, inst.Status())
+	return nil
+}
+
+// Send the instance output in ControlLog messages, and the new output as it
+// comes if following
+func sendLogs(ctx context.Context, cnx *net.UnixConn, req *CtlRequest, clientList *ClientList) error {
+	inst := clientList.Find(req.Instance)
+	if inst == nil {
+		return fmt.Errorf("No instance %#v", req.Instance)
+	}
+
+	inst.Lock()
+	instLog := inst.Log
+	inst.Unlock()
+	if instLog == nil {
+		return fmt.Errorf("No logs for instance %#v", req.Instance)
+	}
+
+	var data []byte
+	var follow chan []byte
+	var err error
+	if req.Follow {
+		data, follow, err = instLog.Follow()
+		if err != nil {
+			return err
+		}
+		defer instLog.Unfollow(follow)
+	} else {
+		data, err = instLog.Tail()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		if len(data) > 0 {
+			h := simpleipc.NewHeader(ControlLog, uint32(len(data)), nil)
+			err = h.WriteWithPayload(cnx, data)
+			if err != nil {
+				return err
+			}
+		}
+		if follow == nil {
+			return nil
+		}
+
+		var ok bool
+		select {
+		case data, ok = <-follow:
+			if !ok {
+				return nil
+			}
+		case <-inst.Done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Send a request to the control socket of a running server. The instance
+// output received for the logs command is written to stdout.
+func ctlRequest(sockPath string, req *CtlRequest) (*CtlResponse, error) {
+	cnx0, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cnx0.Close()
+	cnx := cnx0.(*net.UnixConn)
+
+	h := simpleipc.NewHeader(ControlRequest, 0, nil)
+	err = cjdnserver.WriteJSON(cnx, h, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	for {
+		h = new(simpleipc.Header)
+		payload, err = h.ReadWithPayload(cnx, nil)
+		if err != nil {
+			return nil, err
+		} else if h.Seq == ControlLog {
+			os.Stdout.Write(payload)
+		} else if h.Seq == ControlResponse {
+			break
+		} else {
+			return nil, fmt.Errorf("Received unknown message %d on control socket", h.Seq)
+		}
+	}
+
+	var res CtlResponse
+	err = json.Unmarshal(payload, &res)
+	if err != nil {
+		return nil, err
+	} else if res.Error != "" {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	return &res, nil
+}
+
+// Implement the ctl subcommand: cjdnserver ctl [flags] COMMAND [INSTANCE]
+func runCtl(args []string) error {
+	var sockPath string
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	flags.StringVar(&sockPath, "sock", DefaultCtlSock, "Control socket file path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s ctl [flags] list|inspect|restart|kill [INSTANCE]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s ctl [flags] reload\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s ctl [flags] logs INSTANCE [-f]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "INSTANCE is a network namespace inode, an IPv6 address or a public key\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	req := &CtlRequest{
+		Command:  flags.Arg(0),
+		Instance: flags.Arg(1),
+	}
+	if req.Command == CtlLogs {
+		req.Instance = ""
+		for _, arg := range flags.Args()[1:] {
+			if arg == "-f" || arg == "-follow" || arg == "--follow" {
+				req.Follow = true
+			} else {
+				req.Instance = arg
+			}
+		}
+	}
+	if req.Command == "" || (req.Command != CtlList && req.Command != CtlReload && req.Instance == "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	res, err := ctlRequest(sockPath, req)
+	if err != nil {
+		return err
+	} else if req.Command == CtlLogs {
+		return nil
+	}
+
+	if req.Command == CtlReload {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PEER\tPUBKEY")
+		for _, p := range res.Peers {
+			fmt.Fprintf(w, "%s\t%s\n", p.Address, p.PublicKey)
+		}
+		return w.Flush()
+	}
+
+	if req.Command != CtlList {
+		data, err := json.MarshalIndent(res.Instances[0], "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETNS\tPID\tSTATE\tIPV6\tPUBKEY\tADMIN\tUPTIME\tRESTARTS")
+	for _, st := range res.Instances {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%d\t%s\t%d\n", st.Ino, st.Pid, st.State, st.IPv6, st.PublicKey, st.AdminPort, st.Uptime.Round(time.Second), st.Restarts)
+	}
+	return w.Flush()
+}
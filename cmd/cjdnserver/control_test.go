@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestInstanceHealth(t *testing.T) {
+	upstream := []Peer{{Address: "192.0.2.1:1234", Pubkey: "upstream.k", Password: "secret"}}
+	tests := []struct {
+		name        string
+		pid         int
+		upstream    []Peer
+		peerStats   bool
+		established int
+		healthy     bool
+	}{
+		{"not running", 0, nil, false, 0, false},
+		{"no configured peer", 42, nil, false, 0, true},
+		{"peer stats not read yet", 42, upstream, false, 0, false},
+		{"no established session", 42, upstream, true, 0, false},
+		{"established session", 42, upstream, true, 1, true},
+	}
+	for _, test := range tests {
+		inst := &Instance{
+			Pid:         test.pid,
+			upstream:    test.upstream,
+			peerStats:   test.peerStats,
+			established: test.established,
+		}
+		if h := inst.Health(); h.Healthy != test.healthy {
+			t.Errorf("%s: healthy %v, expected %v", test.name, h.Healthy, test.healthy)
+		}
+	}
+}
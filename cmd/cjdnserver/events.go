@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"github.com/fc00/go-cjdns/admin"
+	"github.com/mildred/cjdnserver"
+	"time"
+)
+
+const (
+	PeerStatsInterval = 10 * time.Second
+	ConnectedInterval = time.Second
+)
+
+// Add a connection that receives the instance events in addition to the
+// client connection
+func (inst *Instance) Subscribe(cnx ClientCnx) {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.subscribers = append(inst.subscribers, cnx)
+}
+
+func (inst *Instance) Unsubscribe(cnx ClientCnx) {
+	inst.Lock()
+	defer inst.Unlock()
+	for i, c := range inst.subscribers {
+		if c == cnx {
+			inst.subscribers = append(inst.subscribers[:i], inst.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Push an event to the client and all subscribers. The client only receives
+// events once it got the initial response it is waiting for.
+func (inst *Instance) Emit(ev *cjdnserver.EventMessage) {
+	ev.Time = time.Now()
+	logger := inst.Logger()
+	logger.Info("Event", "type", ev.Type, "peer", ev.Peer, "reason", ev.Reason)
+
+	inst.Lock()
+	var subscribers []ClientCnx
+	if inst.responded {
+		subscribers = append(subscribers, inst.Cnx)
+	}
+	subscribers = append(subscribers, inst.subscribers...)
+	inst.Unlock()
+
+	for _, cnx := range subscribers {
+		err := cnx.SendEvent(ev)
+		if err != nil {
+			logger.Warn("Send event", "err", err)
+			inst.Unsubscribe(cnx)
+		}
+	}
+}
+
+// Poll the instance admin interface and emit an event when an upstream peer
+// session goes up or down. Return when the context is cancelled.
+func monitorPeers(ctx context.Context, inst *Instance, adminConf *admin.CjdnsAdminConfig) {
+	established := map[string]bool{}
+	var adm *admin.Conn
+	for ctx.Err() == nil {
+		tmout, cancel := context.WithTimeout(ctx, PeerStatsInterval)
+		<-tmout.Done()
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+
+		if adm == nil {
+			var err error
+			adm, err = admin.Connect(adminConf)
+			if err != nil {
+				inst.Logger().Warn("Connect to admin interface", "err", err)
+				adm = nil
+				continue
+			}
+		}
+
+		peers, err := adm.InterfaceController_peerStats()
+		if err != nil {
+			inst.Logger().Warn("InterfaceController_peerStats", "err", err)
+			adm = nil
+			continue
+		}
+
+		count := 0
+		for _, p := range peers {
+			if p.State == "ESTABLISHED" {
+				count++
+			}
+		}
+		inst.Lock()
+		inst.peers = len(peers)
+		inst.established = count
+		inst.peerStats = true
+		inst.Unlock()
+
+		seen := map[string]bool{}
+		for _, p := range peers {
+			pubkey := p.PublicKey.String()
+			seen[pubkey] = true
+			up := p.State == "ESTABLISHED"
+			if up != established[pubkey] {
+				established[pubkey] = up
+				ev := &cjdnserver.EventMessage{Type: cjdnserver.EventPeerDown, Peer: pubkey, Reason: p.State}
+				if up {
+					ev.Type = cjdnserver.EventPeerUp
+				}
+				inst.Emit(ev)
+			}
+		}
+		for pubkey, up := range established {
+			if !seen[pubkey] {
+				delete(established, pubkey)
+				if up {
+					inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventPeerDown, Peer: pubkey, Reason: "removed"})
+				}
+			}
+		}
+	}
+}
+
+// Poll the instance admin interface until a peer session is established, or
+// until target answers to pings if it is not empty. Return false if the timeout
+// expires first.
+func waitConnected(ctx0 context.Context, adminConf *admin.CjdnsAdminConfig, target string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx0, timeout)
+	defer cancel()
+
+	var adm *admin.Conn
+	for {
+		if adm == nil {
+			var err error
+			adm, err = admin.Connect(adminConf)
+			if err != nil {
+				adm = nil
+			}
+		}
+
+		if adm != nil && target != "" {
+			_, _, err := adm.RouterModule_pingNode(target, int(ConnectedInterval/time.Millisecond))
+			if err == nil {
+				return true
+			}
+		} else if adm != nil {
+			peers, err := adm.InterfaceController_peerStats()
+			if err != nil {
+				adm = nil
+			}
+			for _, p := range peers {
+				if p.State == "ESTABLISHED" {
+					return true
+				}
+			}
+		}
+
+		tmout, cancel := context.WithTimeout(ctx, ConnectedInterval)
+		<-tmout.Done()
+		cancel()
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/mildred/cjdnserver"
+	"testing"
+)
+
+type recordCnx struct {
+	events []*cjdnserver.EventMessage
+}
+
+func (c *recordCnx) ReceiveRequest() (*ClientRequest, error) { return nil, nil }
+
+func (c *recordCnx) SendInitialResponse(reply *cjdnserver.InitialReply) error { return nil }
+
+func (c *recordCnx) SendError(err error) error { return nil }
+
+func (c *recordCnx) SendEvent(ev *cjdnserver.EventMessage) error {
+	c.events = append(c.events, ev)
+	return nil
+}
+
+func (c *recordCnx) ReceivePing(ctx context.Context) (error, bool) { return nil, false }
+
+func TestEmitBeforeInitialResponse(t *testing.T) {
+	client := new(recordCnx)
+	subscriber := new(recordCnx)
+	inst := &Instance{Cnx: client}
+	inst.Subscribe(subscriber)
+
+	// The client waits for the initial response and would fail on an event
+	inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventPeerUp})
+	if len(client.events) != 0 {
+		t.Errorf("client received %d events before the initial response", len(client.events))
+	}
+	if len(subscriber.events) != 1 {
+		t.Errorf("subscriber received %d events, expected 1", len(subscriber.events))
+	}
+
+	inst.responded = true
+	inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventPeerDown})
+	if len(client.events) != 1 || client.events[0].Type != cjdnserver.EventPeerDown {
+		t.Errorf("client events %v, expected the peer down event", client.events)
+	}
+	if len(subscriber.events) != 2 {
+		t.Errorf("subscriber received %d events, expected 2", len(subscriber.events))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func newLogHandler(format, level string) (slog.Handler, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("log level: %v", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, opts), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %#v", format)
+	}
+}
+
+// Install the default structured logger. The standard log package also goes
+// through it at the info level.
+func setupLogging(format, level string) error {
+	handler, err := newLogHandler(format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Logger with the instance identity: public key, network namespace inode,
+// cjdroute pid and IPv6 address
+func (inst *Instance) Logger() *slog.Logger {
+	inst.Lock()
+	defer inst.Unlock()
+	return slog.With("instance", inst.PublicKey, "netns", inst.Ino, "pid", inst.Pid, "ipv6", inst.IPv6)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Number of chunks buffered for each follower before it is dropped
+	LogFollowBuffer = 64
+)
+
+// Output of the cjdroute processes of an instance. Lines are prefixed with the
+// time and the network namespace inode and stored in a file rotated when it
+// reaches MaxSize, or in a ring buffer of MaxSize bytes when there is no file.
+type InstanceLog struct {
+	sync.Mutex
+	Path    string
+	MaxSize int64
+	Backups int
+	ino     uint64
+	prefix  string
+	file    *os.File
+	size    int64
+	ring    []byte
+	// Incomplete last line, not prefixed yet
+	partial   []byte
+	followers map[chan []byte]bool
+}
+
+func NewInstanceLog(dir string, ino uint64, maxSize int64, backups int) (*InstanceLog, error) {
+	l := &InstanceLog{
+		MaxSize:   maxSize,
+		Backups:   backups,
+		ino:       ino,
+		prefix:    fmt.Sprintf("netns=%d ", ino),
+		followers: map[chan []byte]bool{},
+	}
+	if dir == "" {
+		return l, nil
+	}
+
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	l.Path = path.Join(dir, fmt.Sprintf("%d.log", ino))
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *InstanceLog) open() error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = st.Size()
+	return nil
+}
+
+// Rename the log file to Path.1, shifting the previous backups, and start a
+// new file
+func (l *InstanceLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	for i := l.Backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+	if l.Backups > 0 {
+		os.Rename(l.Path, l.Path+".1")
+	} else {
+		os.Remove(l.Path)
+	}
+	return l.open()
+}
+
+// Prefix and store complete lines, and send them to the followers
+func (l *InstanceLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.partial = append(l.partial, p...)
+	end := bytes.LastIndexByte(l.partial, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	var data []byte
+	now := time.Now().Format(time.RFC3339) + " "
+	for _, line := range bytes.SplitAfter(l.partial[:end+1], []byte{'\n'}) {
+		if len(line) > 0 {
+			data = append(data, now+l.prefix...)
+			data = append(data, line...)
+		}
+	}
+	l.partial = append([]byte(nil), l.partial[end+1:]...)
+
+	if l.Path == "" {
+		l.ring = append(l.ring, data...)
+		if int64(len(l.ring)) > l.MaxSize {
+			l.ring = append([]byte(nil), l.ring[int64(len(l.ring))-l.MaxSize:]...)
+		}
+	} else {
+		if l.file != nil && l.MaxSize > 0 && l.size+int64(len(data)) > l.MaxSize {
+			err := l.rotate()
+			if err != nil {
+				slog.Warn("Rotate instance log", "netns", l.ino, "path", l.Path, "err", err)
+			}
+		}
+		if l.file != nil {
+			n, err := l.file.Write(data)
+			l.size += int64(n)
+			if err != nil {
+				slog.Warn("Write instance log", "netns", l.ino, "path", l.Path, "err", err)
+			}
+		}
+	}
+
+	for ch := range l.followers {
+		select {
+		case ch <- data:
+		default:
+			// The follower is too slow, stop following
+			delete(l.followers, ch)
+			close(ch)
+		}
+	}
+	return len(p), nil
+}
+
+// Return the recent output: the last backup and the current file, or the ring
+// buffer
+func (l *InstanceLog) tail() ([]byte, error) {
+	if l.Path == "" {
+		return append([]byte(nil), l.ring...), nil
+	}
+
+	var data []byte
+	if l.Backups > 0 {
+		backup, err := ioutil.ReadFile(l.Path + ".1")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		data = backup
+	}
+	current, err := ioutil.ReadFile(l.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(data, current...), nil
+}
+
+func (l *InstanceLog) Tail() ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.tail()
+}
+
+// Return the recent output and a channel receiving the new output. The channel
+// is closed when the log is closed, unfollowed, or when the follower cannot
+// keep up.
+func (l *InstanceLog) Follow() ([]byte, chan []byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	data, err := l.tail()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan []byte, LogFollowBuffer)
+	l.followers[ch] = true
+	return data, ch, nil
+}
+
+func (l *InstanceLog) Unfollow(ch chan []byte) {
+	l.Lock()
+	defer l.Unlock()
+	if l.followers[ch] {
+		delete(l.followers, ch)
+		close(ch)
+	}
+}
+
+func (l *InstanceLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	for ch := range l.followers {
+		delete(l.followers, ch)
+		close(ch)
+	}
+	if l.file != nil {
+		err := l.file.Close()
+		l.file = nil
+		return err
+	}
+	return nil
+}
+
+// Open the FIFO in the instance temporary directory that cjdroute writes its
+// output to, creating it if needed, and copy its content to the instance log.
+// The end given to cjdroute as its stdout and stderr is opened read-write so
+// cjdroute never gets EPIPE and outlives the server with the state directory.
+func (inst *Instance) openOutput() error {
+	fifo := path.Join(inst.Tmpdir, "output")
+	err := syscall.Mkfifo(fifo, 0600)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	r, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	inst.output = w
+	inst.outputReader = r
+
+	instLog := inst.Log
+	go func() {
+		_, err := io.Copy(instLog, r)
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			inst.Logger().Warn("Read cjdroute output", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Close the output FIFO. When cjdroute is detached, nothing reads the FIFO
+// until the next server adopts it: its end is made non-blocking so cjdroute
+// drops its output instead of freezing once the pipe buffer is full.
+func (inst *Instance) closeOutput() {
+	if inst.output != nil {
+		if inst.detached {
+			err := setNonblock(inst.output)
+			if err != nil {
+				inst.Logger().Warn("Make cjdroute output non-blocking", "err", err)
+			}
+		}
+		inst.output.Close()
+		inst.outputReader.Close()
+	}
+	if inst.Log != nil {
+		inst.Log.Close()
+	}
+}
+
+// Set O_NONBLOCK on the open file description, shared with the processes the
+// file was given to
+func setNonblock(f *os.File) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err2 := conn.Control(func(fd uintptr) {
+		err = syscall.SetNonblock(int(fd), true)
+	})
+	if err2 != nil {
+		return err2
+	}
+	return err
+}
@@ -18,6 +18,8 @@
 #include <linux/if.h>
 #include <linux/in6.h>
 #include <linux/ipv6.h>
+#include <linux/ipv6_route.h>
+#include <linux/route.h>
 #include <linux/if_tun.h>
 
 static int socket_for_interface(const char *ifname, struct ifreq* ifRequestOut) {
@@ -144,6 +146,58 @@ static int interface_set_mtu(const char *ifname, int mtu) {
 #endif
 }
 
+static int interface_add_route(const char *ifname, const char *route) {
+    struct ifreq ifr;
+    struct in6_rtmsg rt;
+    char addr[INET6_ADDRSTRLEN];
+    const char *slash = strchr(route, '/');
+    int prefixlen = 128;
+    size_t addrlen = strlen(route);
+
+    if (slash) {
+        addrlen = slash - route;
+        prefixlen = atoi(slash + 1);
+    }
+    if (addrlen >= sizeof(addr) || prefixlen < 0 || prefixlen > 128) {
+        errno = EINVAL;
+        return -errno;
+    }
+    memcpy(addr, route, addrlen);
+    addr[addrlen] = '\0';
+
+    memset (&rt, 0, sizeof (struct in6_rtmsg));
+    if (inet_pton(AF_INET6, addr, &rt.rtmsg_dst) != 1) {
+        errno = EINVAL;
+        return -errno;
+    }
+    rt.rtmsg_dst_len = prefixlen;
+    rt.rtmsg_flags = RTF_UP;
+    rt.rtmsg_metric = 1;
+
+    int s = socket(PF_INET6, SOCK_DGRAM, 0);
+    if(s < 0) {
+        perror("socket");
+        return -errno;
+    }
+
+    memset (&ifr, 0, sizeof (struct ifreq));
+    strncpy (ifr.ifr_name, ifname, IFNAMSIZ);
+    if (-1 == ioctl(s, SIOGIFINDEX, &ifr)) {
+        perror("ioctl(SIOGIFINDEX)");
+        close(s);
+        return -errno;
+    }
+    rt.rtmsg_ifindex = ifr.ifr_ifindex;
+
+    if (-1 == ioctl(s, SIOCADDRT, &rt)) {
+        perror("ioctl(SIOCADDRT)");
+        close(s);
+        return -errno;
+    }
+    close(s);
+    return 0;
+}
+
 static int configure_device(const char *ifname, struct in6_addr *ip, int prefixlen, int mtu) {
     if(interface_up(ifname) < 0) {
         perror("interface_up");
@@ -163,10 +217,9 @@ static int configure_device(const char *ifname, struct in6_addr *ip, int prefixl
     return 0;
 }
 
-static int create_tun_dev(int netnsfd, struct in6_addr *ip, int mtu) {
+static int create_tun_dev(int netnsfd, const char *desiredName, struct in6_addr *ip, int mtu, const char **routes, int nroutes) {
     int tunfd;
     struct ifreq ifr = { 0 };
-    const char *desiredName = "cjdns0";
     const int prefixlen = 8;
 
     if (netnsfd >= 0) {
@@ -177,7 +230,7 @@ static int create_tun_dev(int netnsfd, struct in6_addr *ip, int mtu) {
 
     memset(&ifr, 0, sizeof(ifr));
     ifr.ifr_flags = IFF_TUN;
-    strncpy(ifr.ifr_name, desiredName, strlen(desiredName));
+    strncpy(ifr.ifr_name, desiredName, IFNAMSIZ - 1);
     tunfd = open("/dev/net/tun", O_RDWR);
     if (ioctl(tunfd, TUNSETIFF, (void *)&ifr) < 0) {
         return -errno;
@@ -189,6 +242,14 @@ static int create_tun_dev(int netnsfd, struct in6_addr *ip, int mtu) {
         return -errno;
     }
 
+    for (int i = 0; i < nroutes; i++) {
+        if(interface_add_route(ifr.ifr_name, routes[i]) < 0) {
+            perror("interface_add_route");
+            close(tunfd);
+            return -errno;
+        }
+    }
+
     return tunfd;
 }
 
@@ -241,7 +302,7 @@ static int recvfd(int socket)  {
     return fd;
 }
 
-int make_tun_dev(int netnsfd, const char *ipv6, int mtu) {
+int make_tun_dev(int netnsfd, const char *ifname, const char *ipv6, int mtu, const char **routes, int nroutes) {
     int s[2];
     int tunfd = -EINVAL;
     struct in6_addr ipdata;
@@ -263,7 +324,7 @@ int make_tun_dev(int netnsfd, const char *ipv6, int mtu) {
     } else if(child == 0) {
         close(s[0]); // close read
         printf("[generate tun device] fork to netns fd=%d\n", netnsfd);
-        tunfd = create_tun_dev(netnsfd, &ipdata, mtu);
+        tunfd = create_tun_dev(netnsfd, ifname, &ipdata, mtu, routes, nroutes);
         if(tunfd < 0) {
             perror("create_tun_dev");
             exit(1);
@@ -1,22 +1,41 @@
 package main
 
 /*
-int make_tun_dev(int netns, const char *ipv6, int mtu);
+#include <stdlib.h>
+
+int make_tun_dev(int netns, const char *ifname, const char *ipv6, int mtu, const char **routes, int nroutes);
 */
 import "C"
 
 import (
 	"os"
+	"unsafe"
 )
 
-func MakeTunInNs(netns *os.File, ipv6 string, mtu int) (*os.File, error) {
+func MakeTunInNs(netns *os.File, ifname, ipv6 string, mtu int, routes []string) (*os.File, error) {
 	var netnsfd C.int = -1
 	if netns != nil {
 		netnsfd = C.int(netns.Fd())
 	}
-	tundevfd, err := C.make_tun_dev(netnsfd, C.CString(ipv6), C.int(mtu))
+
+	cifname := C.CString(ifname)
+	defer C.free(unsafe.Pointer(cifname))
+	cipv6 := C.CString(ipv6)
+	defer C.free(unsafe.Pointer(cipv6))
+
+	var croutes **C.char
+	croutesList := make([]*C.char, len(routes))
+	for i, route := range routes {
+		croutesList[i] = C.CString(route)
+		defer C.free(unsafe.Pointer(croutesList[i]))
+	}
+	if len(croutesList) > 0 {
+		croutes = &croutesList[0]
+	}
+
+	tundevfd, err := C.make_tun_dev(netnsfd, cifname, cipv6, C.int(mtu), croutes, C.int(len(routes)))
 	if err != nil {
 		return nil, err
 	}
-	return os.NewFile(uintptr(tundevfd), "cjdns0"), nil
+	return os.NewFile(uintptr(tundevfd), ifname), nil
 }
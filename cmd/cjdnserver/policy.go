@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"net"
+	"strings"
+	"time"
+)
+
+// Limits applied to the interface options requested by clients
+type Policy struct {
+	// Default interface name and MTU
+	InterfaceName      string
+	InterfaceMTU       int
+	AllowInterfaceName bool
+	MinMTU             int
+	MaxMTU             int
+	MaxRoutes          int
+	MaxPeers           int
+	MaxWaitConnected   time.Duration
+	MinWatchdogTimeout time.Duration
+	MaxWatchdogTimeout time.Duration
+	// Default and maximum resource limits, only enforced when cjdroute runs in
+	// a cgroup
+	Limits        cjdnserver.ResourceLimits
+	EnforceLimits bool
+}
+
+// Interface settings for a cjdns instance, after the policy is applied
+type InterfaceSettings struct {
+	Name   string
+	MTU    int
+	Routes []string
+	Peers  []Peer
+	// Connectivity to wait for before answering the client
+	WaitConnected bool
+	WaitTarget    string
+	WaitTimeout   time.Duration
+	// Watchdog agreed with the client
+	WatchdogInterval time.Duration
+	WatchdogTimeout  time.Duration
+	Limits           cjdnserver.ResourceLimits
+}
+
+func (p *Policy) DefaultInterfaceSettings() InterfaceSettings {
+	return InterfaceSettings{
+		Limits:           p.Limits,
+		Name:             p.InterfaceName,
+		MTU:              p.InterfaceMTU,
+		WatchdogInterval: WatchdogInterval,
+		WatchdogTimeout:  WatchdogTimeout,
+	}
+}
+
+// Validate the options requested by the client and return the resulting
+// interface settings with the list of accepted options and the reasons the
+// other options were rejected.
+func (p *Policy) Apply(opts *cjdnserver.InitialMessage) (settings InterfaceSettings, accepted, rejected []string) {
+	settings = p.DefaultInterfaceSettings()
+	if opts == nil {
+		return
+	}
+
+	if opts.Interface != "" {
+		if !p.AllowInterfaceName {
+			rejected = append(rejected, "interface: custom interface names are not allowed")
+		} else if err := validInterfaceName(opts.Interface); err != nil {
+			rejected = append(rejected, fmt.Sprintf("interface: %v", err))
+		} else {
+			settings.Name = opts.Interface
+			accepted = append(accepted, "interface")
+		}
+	}
+
+	if opts.MTU != 0 {
+		if opts.MTU < p.MinMTU {
+			rejected = append(rejected, fmt.Sprintf("mtu: %d is below the minimum %d", opts.MTU, p.MinMTU))
+		} else if opts.MTU > p.MaxMTU {
+			rejected = append(rejected, fmt.Sprintf("mtu: %d is above the maximum %d", opts.MTU, p.MaxMTU))
+		} else {
+			settings.MTU = opts.MTU
+			accepted = append(accepted, "mtu")
+		}
+	}
+
+	if len(opts.Routes) > p.MaxRoutes {
+		rejected = append(rejected, fmt.Sprintf("routes: %d routes requested, at most %d allowed", len(opts.Routes), p.MaxRoutes))
+	} else if len(opts.Routes) > 0 {
+		var errs []string
+		for _, route := range opts.Routes {
+			_, ipnet, err := net.ParseCIDR(route)
+			if err != nil {
+				errs = append(errs, err.Error())
+			} else if ipnet.IP.To4() != nil {
+				errs = append(errs, fmt.Sprintf("%s is not an IPv6 route", route))
+			} else {
+				settings.Routes = append(settings.Routes, ipnet.String())
+			}
+		}
+		if len(errs) > 0 {
+			settings.Routes = nil
+			rejected = append(rejected, fmt.Sprintf("routes: %s", strings.Join(errs, ", ")))
+		} else {
+			accepted = append(accepted, "routes")
+		}
+	}
+
+	if len(opts.Peers) > p.MaxPeers {
+		rejected = append(rejected, fmt.Sprintf("peers: %d peers requested, at most %d allowed", len(opts.Peers), p.MaxPeers))
+	} else if len(opts.Peers) > 0 {
+		var errs []string
+		for _, peer := range opts.Peers {
+			if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+				errs = append(errs, err.Error())
+			} else if peer.PublicKey == "" {
+				errs = append(errs, fmt.Sprintf("%s has no public key", peer.Address))
+			} else {
+				settings.Peers = append(settings.Peers, Peer{
+					Address:  peer.Address,
+					Password: peer.Password,
+					Pubkey:   peer.PublicKey,
+				})
+			}
+		}
+		if len(errs) > 0 {
+			settings.Peers = nil
+			rejected = append(rejected, fmt.Sprintf("peers: %s", strings.Join(errs, ", ")))
+		} else {
+			accepted = append(accepted, "peers")
+		}
+	}
+
+	if opts.WaitConnected {
+		timeout := time.Duration(opts.WaitTimeout) * time.Second
+		if opts.WaitTarget != "" && !validCjdnsAddress(opts.WaitTarget) {
+			rejected = append(rejected, fmt.Sprintf("wait-connected: %s is not a cjdns address", opts.WaitTarget))
+		} else if p.MaxWaitConnected <= 0 {
+			rejected = append(rejected, "wait-connected: waiting for connectivity is not allowed")
+		} else {
+			if timeout <= 0 || timeout > p.MaxWaitConnected {
+				timeout = p.MaxWaitConnected
+			}
+			settings.WaitConnected = true
+			settings.WaitTarget = opts.WaitTarget
+			settings.WaitTimeout = timeout
+			accepted = append(accepted, "wait-connected")
+		}
+	}
+
+	if opts.WatchdogTimeout != 0 || opts.WatchdogInterval != 0 {
+		timeout := time.Duration(opts.WatchdogTimeout) * time.Second
+		if timeout == 0 {
+			timeout = WatchdogTimeout
+		}
+		if timeout < p.MinWatchdogTimeout {
+			timeout = p.MinWatchdogTimeout
+		} else if timeout > p.MaxWatchdogTimeout {
+			timeout = p.MaxWatchdogTimeout
+		}
+		// Leave room for at least one missed ping
+		interval := time.Duration(opts.WatchdogInterval) * time.Second
+		if interval <= 0 || interval > timeout/2 {
+			interval = timeout / 2
+		}
+		if interval < time.Second {
+			interval = time.Second
+		}
+		settings.WatchdogInterval = interval
+		settings.WatchdogTimeout = timeout
+		accepted = append(accepted, "watchdog")
+	}
+
+	if opts.Limits != nil && !p.EnforceLimits {
+		rejected = append(rejected, "limits: resource limits are not enforced by this server")
+	} else if opts.Limits != nil {
+		var errs []string
+		limits := p.Limits
+		if opts.Limits.MemoryMax > 0 {
+			if p.Limits.MemoryMax > 0 && opts.Limits.MemoryMax > p.Limits.MemoryMax {
+				errs = append(errs, fmt.Sprintf("memory %d is above the maximum %d", opts.Limits.MemoryMax, p.Limits.MemoryMax))
+			}
+			limits.MemoryMax = opts.Limits.MemoryMax
+		}
+		if opts.Limits.CPUMax > 0 {
+			if p.Limits.CPUMax > 0 && opts.Limits.CPUMax > p.Limits.CPUMax {
+				errs = append(errs, fmt.Sprintf("cpu %g is above the maximum %g", opts.Limits.CPUMax, p.Limits.CPUMax))
+			}
+			limits.CPUMax = opts.Limits.CPUMax
+		}
+		if opts.Limits.PidsMax > 0 {
+			if p.Limits.PidsMax > 0 && opts.Limits.PidsMax > p.Limits.PidsMax {
+				errs = append(errs, fmt.Sprintf("pids %d is above the maximum %d", opts.Limits.PidsMax, p.Limits.PidsMax))
+			}
+			limits.PidsMax = opts.Limits.PidsMax
+		}
+		if len(errs) > 0 {
+			rejected = append(rejected, fmt.Sprintf("limits: %s", strings.Join(errs, ", ")))
+		} else {
+			settings.Limits = limits
+			accepted = append(accepted, "limits")
+		}
+	}
+
+	// The watchdog runs while waiting for connectivity, the client must be
+	// able to send its first ping before it expires
+	if max := settings.WatchdogTimeout - settings.WatchdogInterval; settings.WaitConnected && settings.WaitTimeout > max {
+		settings.WaitTimeout = max
+	}
+
+	return
+}
+
+func validCjdnsAddress(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil && ip[0] == 0xfc
+}
+
+func validInterfaceName(name string) error {
+	if len(name) >= 16 {
+		return fmt.Errorf("%#v is longer than 15 characters", name)
+	} else if name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("%#v is not a valid interface name", name)
+	}
+	return nil
+}
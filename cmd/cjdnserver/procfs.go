@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 func GetPPidOf(pid int) (int, error) {
@@ -22,6 +25,15 @@ func GetPPidOf(pid int) (int, error) {
 	return -1, fmt.Errorf("No PPid in /proc/%d/status", pid)
 }
 
+// Return the command name of the process
+func GetCommOf(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func GetEnvironOf(pid int, name string) (string, error) {
 	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 	if err != nil {
@@ -35,3 +47,60 @@ func GetEnvironOf(pid int, name string) (string, error) {
 	}
 	return "", nil
 }
+
+// Return the start time of the process, in clock ticks since boot, to tell it
+// apart from a later process reusing the same pid
+func GetStartTimeOf(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parenthesis can contain spaces
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("Invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// starttime is the 22nd field, the 20th after the command name
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("Invalid /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// Duplicate the tun device file descriptor held by the process
+func GetTunFdOf(pid int) (*os.File, error) {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(path.Join(fdDir, fd.Name()))
+		if err != nil || target != "/dev/net/tun" {
+			continue
+		}
+		targetfd, err := strconv.Atoi(fd.Name())
+		if err != nil {
+			continue
+		}
+
+		pidfd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+		if errno != 0 {
+			return nil, fmt.Errorf("pidfd_open: %v", errno)
+		}
+		defer syscall.Close(int(pidfd))
+
+		tunfd, _, errno := syscall.Syscall(sysPidfdGetfd, pidfd, uintptr(targetfd), 0)
+		if errno != 0 {
+			return nil, fmt.Errorf("pidfd_getfd: %v", errno)
+		}
+		return os.NewFile(tunfd, "tun"), nil
+	}
+	return nil, fmt.Errorf("No tun device in %s", fdDir)
+}
+
+const (
+	sysPidfdOpen  = 434
+	sysPidfdGetfd = 438
+)
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fc00/go-cjdns/admin"
+	"github.com/mildred/cjdnserver"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// Read a file containing a JSON array of peers, with comments
+func readPeersFile(file string) ([]Peer, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := stripComments(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	var peers []Peer
+	err = json.Unmarshal(data, &peers)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i := range peers {
+		if err := validPeer(&peers[i]); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return peers, nil
+}
+
+// Upstream peer of the configuration file, with the values given on the
+// command line and, when left empty, the values detected at startup
+func (srv *Server) filePeer(p Peer) Peer {
+	if srv.PeerFlags["peer-address"] {
+		p.Address = srv.Peer.Address
+	}
+	if srv.PeerFlags["peer-password"] || p.Password == "" {
+		p.Password = srv.Peer.Password
+	}
+	if srv.PeerFlags["peer-pubkey"] || p.Pubkey == "" {
+		p.Pubkey = srv.Peer.Pubkey
+	}
+	return p
+}
+
+// Read the upstream peers from the command line peer, the configuration file
+// and the peers file
+func (srv *Server) readUpstream() ([]Peer, error) {
+	var peers []Peer
+	peer := *srv.Peer
+	var filePeers []Peer
+	if srv.ConfigFile != "" {
+		cfg := DefaultConfig()
+		err := cfg.Load(srv.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		peer = srv.filePeer(cfg.Peer)
+		if peer.Address != "" {
+			if err := validPeer(&peer); err != nil {
+				return nil, fmt.Errorf("%s: %v", srv.ConfigFile, err)
+			}
+		}
+		for i := range cfg.Peers {
+			if err := validPeer(&cfg.Peers[i]); err != nil {
+				return nil, fmt.Errorf("%s: %v", srv.ConfigFile, err)
+			}
+		}
+		filePeers = cfg.Peers
+	}
+	if peer.Address != "" {
+		peers = append(peers, peer)
+	}
+	peers = append(peers, filePeers...)
+	if srv.PeersFile != "" {
+		filePeers, err := readPeersFile(srv.PeersFile)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, filePeers...)
+	}
+	return peers, nil
+}
+
+func (srv *Server) UpstreamPeers() []Peer {
+	srv.Lock()
+	defer srv.Unlock()
+	return append([]Peer{}, srv.upstream...)
+}
+
+// Read the upstream peers again and push the changes to the instances without
+// restarting cjdroute
+func (srv *Server) Reload() error {
+	srv.reloading.Lock()
+	defer srv.reloading.Unlock()
+
+	peers, err := srv.readUpstream()
+	if err != nil {
+		return err
+	}
+	srv.Lock()
+	srv.upstream = peers
+	srv.Unlock()
+	slog.Info("Reload upstream peers", "peers", len(peers))
+
+	for _, inst := range srv.Clients.List() {
+		err := srv.updatePeers(inst, peers)
+		if err != nil {
+			inst.Logger().Warn("Update upstream peers", "err", err)
+		}
+	}
+	return nil
+}
+
+// Peers of b that are not in a
+func missingPeers(a, b []Peer) []Peer {
+	var res []Peer
+	for _, p := range b {
+		found := false
+		for _, q := range a {
+			found = found || p == q
+		}
+		if !found {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Change the upstream peers of the instance. The configuration is updated for
+// the next time cjdroute restarts, and the running cjdroute connects to the new
+// peers and disconnects from the stale ones through its admin interface.
+func (srv *Server) updatePeers(inst *Instance, peers []Peer) error {
+	inst.Lock()
+	if inst.Conf == nil {
+		// Not configured yet
+		inst.Unlock()
+		return nil
+	}
+	added := missingPeers(inst.upstream, peers)
+	stale := missingPeers(peers, inst.upstream)
+	conf := *inst.Conf
+	adminConf := inst.AdminConf
+	running := inst.Pid != 0 && inst.state == StateRunning
+	inst.Unlock()
+	if len(added) == 0 && len(stale) == 0 {
+		return nil
+	}
+
+	var err error
+	conf.Data, err = updateConnectTo(conf.Data, added, stale)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(inst.Tmpdir, "cjdroute.conf"), []byte(conf.Data), 0644)
+	if err != nil {
+		return err
+	}
+
+	inst.Lock()
+	inst.Conf = &conf
+	inst.upstream = peers
+	if inst.Reply != nil {
+		reply := *inst.Reply
+		reply.Peers = nil
+		for _, p := range inst.Reply.Peers {
+			keep := true
+			for _, s := range stale {
+				keep = keep && s.Address != p.Address
+			}
+			if keep {
+				reply.Peers = append(reply.Peers, p)
+			}
+		}
+		for _, p := range added {
+			reply.Peers = append(reply.Peers, cjdnserver.PeerInfo{Address: p.Address, PublicKey: p.Pubkey})
+		}
+		inst.Reply = &reply
+	}
+	inst.Unlock()
+	srv.saveState(inst)
+
+	if !running {
+		return nil
+	}
+
+	logger := inst.Logger()
+	adm, err := admin.Connect(&adminConf)
+	if err != nil {
+		return fmt.Errorf("connect to admin interface: %v", err)
+	}
+	var errs []string
+	for _, p := range stale {
+		logger.Info("Disconnect from upstream peer", "address", p.Address, "peer", p.Pubkey)
+		err = adm.InterfaceController_disconnectPeer(p.Pubkey)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("disconnect %s: %v", p.Address, err))
+		}
+	}
+	for _, p := range added {
+		logger.Info("Connect to upstream peer", "address", p.Address, "peer", p.Pubkey)
+		err = adm.UDPInterface_beginConnection(p.Pubkey, p.Address, 0, p.Password)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("connect %s: %v", p.Address, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"time"
+)
+
+// Restart modes
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// Instance states reported to operators and clients
+const (
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateFailed     = "failed"
+)
+
+// When and how fast cjdroute is restarted after it terminates
+type RestartPolicy struct {
+	Mode string
+	// Delay before the first restart, doubled for each restart in the window
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Give up after MaxRestarts restarts within Window (0 for no limit)
+	MaxRestarts int
+	Window      time.Duration
+}
+
+func (p *RestartPolicy) Validate() error {
+	switch p.Mode {
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("unknown restart mode %#v", p.Mode)
+	}
+	if p.MinBackoff <= 0 || p.MaxBackoff < p.MinBackoff {
+		return fmt.Errorf("invalid restart backoff %v to %v", p.MinBackoff, p.MaxBackoff)
+	}
+	return nil
+}
+
+// Decide whether to restart cjdroute after it terminated at the given time,
+// and return the delay to wait first. recent holds the times of the previous
+// restarts and is updated.
+func (p *RestartPolicy) Next(failed bool, now time.Time, recent *[]time.Time) (time.Duration, error) {
+	if p.Mode == RestartNever || (p.Mode == RestartOnFailure && !failed) {
+		return 0, fmt.Errorf("restart policy is %s", p.Mode)
+	}
+
+	var kept []time.Time
+	for _, t := range *recent {
+		if p.Window == 0 || now.Sub(t) < p.Window {
+			kept = append(kept, t)
+		}
+	}
+	*recent = kept
+	if p.MaxRestarts > 0 && len(kept) >= p.MaxRestarts {
+		return 0, fmt.Errorf("%d restarts within %v", len(kept), p.Window)
+	}
+	*recent = append(kept, now)
+
+	delay := p.MinBackoff
+	for i := 0; i < len(kept) && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay, nil
+}
+
+// Apply the restart policy after cjdroute terminated and wait for the backoff
+// delay. When the policy gives up after a failure, the instance stays in the
+// failed state until it is released or restarted by an operator. Return false
+// if the instance must stop.
+func (inst *Instance) waitRestart(ctx context.Context, policy *RestartPolicy, failed, requested bool) bool {
+	var delay time.Duration
+	if !requested {
+		var err error
+		inst.Lock()
+		delay, err = policy.Next(failed, time.Now(), &inst.recentRestarts)
+		inst.Unlock()
+		if err != nil && !failed {
+			inst.Logger().Info("Not restarting cjdroute", "reason", err)
+			inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventShuttingDown, IPv6: inst.IPv6, Reason: err.Error()})
+			return false
+		} else if err != nil {
+			inst.Logger().Error("Giving up restarting cjdroute", "reason", err)
+			inst.setState(StateFailed)
+			inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventFailed, IPv6: inst.IPv6, Reason: err.Error()})
+			select {
+			case <-ctx.Done():
+				return false
+			case <-inst.restart:
+				inst.Logger().Info("Restart requested")
+				inst.Lock()
+				inst.recentRestarts = nil
+				inst.Unlock()
+			}
+		}
+	}
+
+	inst.setState(StateRestarting)
+	if delay > 0 {
+		inst.Logger().Info("Restart cjdroute", "delay", delay)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-inst.restart:
+		case <-timer.C:
+		}
+	}
+
+	inst.Lock()
+	inst.Restarts++
+	inst.Unlock()
+	return true
+}
+
+// Current state, the caller must hold the lock
+func (inst *Instance) stateName() string {
+	if inst.state == "" {
+		return StateStarting
+	}
+	return inst.state
+}
+
+func (inst *Instance) setState(state string) {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.state = state
+}
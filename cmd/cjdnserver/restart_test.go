@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyNext(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ago := func(d ...time.Duration) []time.Time {
+		var res []time.Time
+		for _, x := range d {
+			res = append(res, now.Add(-x))
+		}
+		return res
+	}
+	policy := func(mode string) *RestartPolicy {
+		return &RestartPolicy{
+			Mode:        mode,
+			MinBackoff:  time.Second,
+			MaxBackoff:  10 * time.Second,
+			MaxRestarts: 5,
+			Window:      time.Minute,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		policy  *RestartPolicy
+		failed  bool
+		recent  []time.Time
+		delay   time.Duration
+		err     bool
+		restart int
+	}{
+		{"never after failure", policy(RestartNever), true, nil, 0, true, 0},
+		{"never after clean exit", policy(RestartNever), false, nil, 0, true, 0},
+		{"on-failure after clean exit", policy(RestartOnFailure), false, nil, 0, true, 0},
+		{"on-failure after failure", policy(RestartOnFailure), true, nil, time.Second, false, 1},
+		{"always after clean exit", policy(RestartAlways), false, nil, time.Second, false, 1},
+		{"backoff doubles", policy(RestartAlways), true, ago(2 * time.Second), 2 * time.Second, false, 2},
+		{"backoff doubles again", policy(RestartAlways), true, ago(4*time.Second, 2*time.Second), 4 * time.Second, false, 3},
+		{"backoff capped", policy(RestartAlways), true, ago(8*time.Second, 6*time.Second, 4*time.Second, 2*time.Second), 10 * time.Second, false, 5},
+		{"window expiry resets the count", policy(RestartAlways), true, ago(3*time.Minute, 2*time.Minute, 90*time.Second, 61*time.Second, 2*time.Second), 2 * time.Second, false, 2},
+		{"max restarts reached", policy(RestartAlways), true, ago(50*time.Second, 40*time.Second, 30*time.Second, 20*time.Second, 10*time.Second), 0, true, 5},
+		{"no limit", &RestartPolicy{Mode: RestartAlways, MinBackoff: time.Second, MaxBackoff: time.Second}, true, ago(time.Hour, 2*time.Second, time.Second), time.Second, false, 4},
+	}
+
+	for _, test := range tests {
+		recent := test.recent
+		delay, err := test.policy.Next(test.failed, now, &recent)
+		if test.err && err == nil {
+			t.Errorf("%s: expected an error, got delay %v", test.name, delay)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if delay != test.delay {
+			t.Errorf("%s: delay %v, expected %v", test.name, delay, test.delay)
+		}
+		if len(recent) != test.restart {
+			t.Errorf("%s: %d recent restarts, expected %d", test.name, len(recent), test.restart)
+		}
+	}
+}
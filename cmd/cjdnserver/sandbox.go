@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	PR_SET_SECCOMP              = 22
+	PR_SET_NO_NEW_PRIVS         = 38
+	PR_CAP_AMBIENT              = 47
+	PR_CAP_AMBIENT_CLEAR_ALL    = 4
+	SECCOMP_MODE_FILTER         = 2
+	SizeofSockFilter            = 8
+	MaxSeccompFilterInstruction = 4096
+)
+
+// How cjdroute is confined. Uid and Gid are -1 to keep the server credentials.
+type Sandbox struct {
+	Uid int
+	Gid int
+	// File containing a compiled seccomp BPF program (an array of struct
+	// sock_filter as exported by seccomp_export_bpf)
+	Seccomp string
+}
+
+// Resolve the user and group names or numeric ids. Without a group, the
+// primary group of the user is used.
+func lookupIds(username, groupname string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if username != "" {
+		var u *user.User
+		if id, err1 := strconv.Atoi(username); err1 == nil {
+			u, err = user.LookupId(username)
+			if err != nil && groupname != "" {
+				// Unknown numeric user with an explicit group
+				uid, err = id, nil
+			}
+		} else {
+			u, err = user.Lookup(username)
+		}
+		if err != nil {
+			return
+		} else if u != nil {
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if groupname != "" {
+		var g *user.Group
+		if _, err = strconv.Atoi(groupname); err == nil {
+			g, err = user.LookupGroupId(groupname)
+		} else {
+			g, err = user.LookupGroup(groupname)
+		}
+		if err != nil {
+			return
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return
+}
+
+// Whether the sandbox does anything and cjdroute must be started through the
+// sandbox subcommand
+func (sb *Sandbox) Enabled() bool {
+	return sb != nil && (sb.Uid >= 0 || sb.Gid >= 0 || sb.Seccomp != "")
+}
+
+// Give the tun socket directory to the cjdroute user so it can create its tun
+// socket there. The instance temporary directory around it stays owned by root
+// since the server writes the configuration and output FIFO in it, cjdroute
+// may only traverse it.
+func (sb *Sandbox) Chown(tmpdir, tundir string) error {
+	if sb == nil || (sb.Uid < 0 && sb.Gid < 0) {
+		return nil
+	}
+	err := os.Chmod(tmpdir, 0711)
+	if err != nil {
+		return err
+	}
+	return os.Chown(tundir, sb.Uid, sb.Gid)
+}
+
+// Command running argv through the sandbox subcommand, moved to cgroup if not
+// empty
+func (sb *Sandbox) Command(cgroup string, argv ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"sandbox", "-cgroup", cgroup}
+	if sb != nil {
+		args = append(args, "-uid", strconv.Itoa(sb.Uid), "-gid", strconv.Itoa(sb.Gid), "-seccomp", sb.Seccomp)
+	}
+	args = append(args, "--")
+	return exec.Command(self, append(args, argv...)...), nil
+}
+
+// Entry point of the sandbox subcommand: move to the cgroup, drop privileges
+// and execute the command
+func runSandbox(args []string) error {
+	var cgroup, seccomp string
+	var uid, gid int
+	fs := flag.NewFlagSet("sandbox", flag.ExitOnError)
+	fs.StringVar(&cgroup, "cgroup", "", "Move to this cgroup")
+	fs.IntVar(&uid, "uid", -1, "Run as this user id")
+	fs.IntVar(&gid, "gid", -1, "Run as this group id")
+	fs.StringVar(&seccomp, "seccomp", "", "Load this seccomp BPF program")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("sandbox: missing command")
+	}
+
+	argv0, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var filter []byte
+	if seccomp != "" {
+		filter, err = ioutil.ReadFile(seccomp)
+		if err != nil {
+			return err
+		} else if len(filter) == 0 || len(filter)%SizeofSockFilter != 0 || len(filter)/SizeofSockFilter > MaxSeccompFilterInstruction {
+			return fmt.Errorf("%s: invalid seccomp BPF program", seccomp)
+		}
+	}
+
+	if cgroup != "" {
+		err = ioutil.WriteFile(path.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// no_new_privs and the seccomp filter apply to the calling thread, it must
+	// be the one calling execve
+	runtime.LockOSThread()
+
+	if gid >= 0 {
+		err = syscall.Setgroups([]int{})
+		if err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		err = syscall.Setgid(gid)
+		if err != nil {
+			return fmt.Errorf("setgid: %v", err)
+		}
+	}
+	if uid >= 0 {
+		err = syscall.Setuid(uid)
+		if err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, PR_CAP_AMBIENT, PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("clear ambient capabilities: %v", errno)
+	}
+	_, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("set no_new_privs: %v", errno)
+	}
+
+	if filter != nil {
+		prog := struct {
+			Len    uint16
+			Filter unsafe.Pointer
+		}{
+			Len:    uint16(len(filter) / SizeofSockFilter),
+			Filter: unsafe.Pointer(&filter[0]),
+		}
+		_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_SECCOMP, SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)))
+		if errno != 0 {
+			return fmt.Errorf("load seccomp filter: %v", errno)
+		}
+	}
+
+	return syscall.Exec(argv0, fs.Args(), os.Environ())
+}
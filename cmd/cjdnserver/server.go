@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,8 +14,10 @@ import (
 	"github.com/mildred/simpleipc"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"regexp"
@@ -26,45 +29,206 @@ import (
 )
 
 const (
-	InterfaceMTU = 1304
+	InterfaceMTU  = 1304
+	InterfaceName = "cjdns0"
+	// Prefix length is set by maketundev.c
+	InterfacePrefixLen = 8
+	// Watchdog used when the client does not propose one
+	WatchdogInterval = 30 * time.Second
+	WatchdogTimeout  = time.Minute
 )
 
 type Peer struct {
-	Address  string
-	Password string
-	Pubkey   string
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	Pubkey   string `json:"publicKey"`
+}
+
+// Configuration and state shared by all instances
+type Server struct {
+	sync.Mutex
+	Cjdroute string
+	// Upstream peer given on the command line, and files containing more
+	// upstream peers, read again when reloading
+	Peer *Peer
+	// Names of the -peer-* flags given on the command line, they override the
+	// configuration file when reloading
+	PeerFlags  map[string]bool
+	ConfigFile string
+	PeersFile  string
+	Policy     *Policy
+	Clients    *ClientList
+	// Directory where the instance state is persisted, empty to stop all
+	// instances when the server shuts down
+	StateDir string
+	// Closed when the server shuts down
+	Shutdown <-chan struct{}
+	Restart  *RestartPolicy
+	Stop     *StopPolicy
+	// Command names of the processes ignored when detecting network
+	// namespaces
+	DetectIgnore []string
+	// Parent of the instance cgroups, empty to leave cjdroute in the server
+	// cgroup
+	CgroupParent string
+	Sandbox      *Sandbox
+	// Directory of the instance log files, empty to keep the logs in memory
+	LogDir     string
+	LogMaxSize int64
+	LogBackups int
+	// Service manager notifications, nil without systemd
+	Notifier *Notifier
+	// Upstream peers of all instances
+	upstream []Peer
+	// Held while reloading
+	reloading sync.Mutex
+}
+
+// Whether the server is shutting down and leaves instances running
+func (srv *Server) detaching() bool {
+	if srv.StateDir == "" {
+		return false
+	}
+	select {
+	case <-srv.Shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Capabilities offered to clients. Resource limits are only offered when they
+// are enforced with cgroups.
+func (srv *Server) Capabilities() []string {
+	var caps []string
+	for _, c := range cjdnserver.Capabilities {
+		if c != cjdnserver.CapLimits || srv.CgroupParent != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// Whether processes with this command name are ignored when detecting network
+// namespaces
+func (srv *Server) ignored(comm string) bool {
+	for _, c := range srv.DetectIgnore {
+		if c == comm {
+			return true
+		}
+	}
+	return false
+}
+
+// Release the instance resources once it is stopped
+func (srv *Server) cleanup(inst *Instance) {
+	srv.Clients.Remove(inst)
+	if inst.TunFd != nil {
+		inst.TunFd.Close()
+	}
+	inst.closeOutput()
+	if !inst.detached {
+		if inst.Tmpdir != "" {
+			os.RemoveAll(inst.Tmpdir)
+		}
+		if inst.Cgroup != "" {
+			err := RemoveCgroup(inst.Cgroup)
+			if err != nil {
+				inst.Logger().Warn("Remove cgroup", "cgroup", inst.Cgroup, "err", err)
+			}
+		}
+		srv.removeState(inst)
+	}
+	close(inst.Done)
 }
 
 func main() {
-	var peer Peer
-	var sockPath string
-	var perms string
-	var cjdroute string
-	var detectNetNs bool
-	flag.StringVar(&sockPath, "sock", "/run/cjdnserver/cjdserver.sock", "Socket file path")
-	flag.StringVar(&perms, "perms", "0755", "Socket permissions")
-	flag.StringVar(&cjdroute, "cjdroute", "cjdroute", "cjdroute executable")
-	flag.StringVar(&peer.Address, "peer-address", "0.0.0.0:33097", "Peer address to connect to over UDP")
-	flag.StringVar(&peer.Password, "peer-password", "", "Peer password")
-	flag.StringVar(&peer.Pubkey, "peer-pubkey", "", "Peer public key")
-	flag.BoolVar(&detectNetNs, "detect-netns", false, "Detect network namespace and instanciate cjdns for them")
-	flag.Parse()
-
-	perms1, _ := strconv.ParseInt(perms, 8, 32)
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		err := runCtl(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		err := runCheckConfig(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "sandbox" {
+		err := runSandbox(os.Args[2:])
+		log.Fatal(err)
+	}
+
+	cfg, configFile, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupLogging(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sandbox, err := cfg.Sandbox()
+	if err != nil {
+		log.Fatal(err)
+	}
+	peerFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "peer-") {
+			peerFlags[f.Name] = true
+		}
+	})
+
+	perms, _ := strconv.ParseInt(cfg.Listen.Perms, 8, 32)
 
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 	cjdnserver.CancelSignals(ctx, &wg, cancel, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	err := run(ctx, &wg, cjdroute, sockPath, os.FileMode(perms1), &peer, detectNetNs)
+	srv := &Server{
+		Cjdroute:   cfg.Cjdroute.Path,
+		Peer:       &cfg.Peer,
+		PeerFlags:  peerFlags,
+		ConfigFile: configFile,
+		PeersFile:  cfg.PeersFile,
+		Policy:     cfg.Policy(),
+		Clients:    NewClientList(cfg.Quotas.MaxInstances),
+		StateDir:   cfg.StateDir,
+		Shutdown:   ctx.Done(),
+		Restart:    cfg.RestartPolicy(),
+		Stop:       cfg.StopPolicy(),
+
+		DetectIgnore: cfg.Detect.IgnoreCommands,
+		CgroupParent: cfg.Cjdroute.CgroupParent,
+		Sandbox:      sandbox,
+		LogDir:       cfg.Log.Dir,
+		LogMaxSize:   cfg.Log.MaxSize,
+		LogBackups:   cfg.Log.Backups,
+		Notifier:     NewNotifier(),
+	}
+
+	drainTimeout := time.Duration(cfg.Stop.DrainTimeout)
+	err = run(ctx, &wg, srv, cfg.Listen.Sock, cfg.Listen.CtlSock, os.FileMode(perms), cfg.Detect.Enabled)
+	cancel()
+	if !cjdnserver.WaitTimeout(&wg, drainTimeout) {
+		for _, inst := range srv.Clients.List() {
+			inst.Logger().Error("Instance did not stop in time")
+		}
+		log.Fatalf("Instances did not stop within %v", drainTimeout)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(ctx0 context.Context, wg *sync.WaitGroup, cjdroute, sockPath string, perms os.FileMode, peer *Peer, detectNetNs bool) error {
+func run(ctx0 context.Context, wg *sync.WaitGroup, srv *Server, sockPath, ctlSockPath string, perms os.FileMode, detectNetNs bool) error {
 	ctx, cancel := context.WithCancel(ctx0)
+	peer := srv.Peer
 
 	var adm *admin.Conn
 	if peer.Pubkey == "" || peer.Password == "" {
@@ -104,10 +268,10 @@ func run(ctx0 context.Context, wg *sync.WaitGroup, cjdroute, sockPath string, pe
 			return err
 		}
 		peer.Pubkey = node.Key
-		log.Printf("Detect peer public key: %s", peer.Pubkey)
+		slog.Info("Detect peer public key", "pubkey", peer.Pubkey)
 	}
 	if peer.Password == "" {
-		log.Printf("Register \"cjdnserver peers\" with admin interface")
+		slog.Info("Register peer password with admin interface", "user", "cjdnserver peers")
 		peer.Password = genpass.Generate(32)
 		err := adm.AuthorizedPasswords_add("cjdnserver peers", peer.Password, 0)
 		if err != nil {
@@ -115,32 +279,48 @@ func run(ctx0 context.Context, wg *sync.WaitGroup, cjdroute, sockPath string, pe
 		}
 
 		defer func() {
-			log.Printf("Unregister \"cjdnserver peers\" from admin interface")
+			slog.Info("Unregister peer password from admin interface", "user", "cjdnserver peers")
 			err := adm.AuthorizedPasswords_remove("cjdnserver peers")
 			if err != nil {
-				log.Println(err)
+				slog.Warn("AuthorizedPasswords_remove", "err", err)
 			}
 		}()
 	}
 
-	var l net.Listener
-	err := os.MkdirAll(path.Dir(sockPath), 0755)
+	upstream, err := srv.readUpstream()
 	if err != nil {
 		return err
 	}
-	_, err = os.Stat(sockPath)
-	if err == nil {
-		log.Printf("Remove %s", sockPath)
-		err = os.Remove(sockPath)
-		if err != nil {
-			return err
+	srv.upstream = upstream
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				err := srv.Reload()
+				if err != nil {
+					slog.Error("Reload", "err", err)
+				}
+			}
 		}
-	}
-	log.Printf("Listen on %s", sockPath)
-	l, err = net.Listen("unix", sockPath)
+	}()
+
+	activated, err := systemdListeners()
 	if err != nil {
 		return err
 	}
+	l := takeListener(activated, SdClientSocket, sockPath)
+	if l == nil {
+		l, err = listenUnix(sockPath, perms)
+		if err != nil {
+			return err
+		}
+	}
 	defer l.Close()
 
 	go func() {
@@ -148,37 +328,59 @@ func run(ctx0 context.Context, wg *sync.WaitGroup, cjdroute, sockPath string, pe
 		l.Close()
 	}()
 
-	log.Printf("Chmod %s to 0%s", sockPath, strconv.FormatInt(int64(perms), 8))
-	err = os.Chmod(sockPath, perms)
-	if err != nil {
-		log.Print(err)
+	nsList := srv.adoptInstances(ctx, wg)
+
+	ctl := takeListener(activated, SdControlSocket, ctlSockPath)
+	if ctl == nil && ctlSockPath != "" {
+		ctl, err = listenUnix(ctlSockPath, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	for name, l := range activated {
+		slog.Warn("Unused activated socket", "name", name, "addr", l.Addr().String())
+		l.Close()
 	}
+	if ctl != nil {
+		defer ctl.Close()
+
+		go func() {
+			<-ctx.Done()
+			ctl.Close()
+		}()
 
-	clientList := NewClientList()
+		go serveControl(ctx, wg, ctl, srv)
+	}
 
 	if detectNetNs {
 		wg.Add(1)
 		go func() {
-			err := detectProcesses(ctx, wg, clientList, cjdroute, peer)
+			defer wg.Done()
+			err := detectProcesses(ctx, wg, srv, nsList)
 			if err != nil {
-				log.Print(err)
+				slog.Error("Detect network namespaces", "err", err)
 			}
 			cancel()
 		}()
 	}
 
+	go srv.Notifier.Run(ctx, srv.Clients)
+
+	var backoff acceptBackoff
 	for ctx.Err() == nil {
 		cnx, err := l.Accept()
 		if err != nil {
-			log.Printf("accept error: %v", err)
+			backoff.Wait(ctx, "Accept client connection", err)
 			continue
 		}
+		backoff.Reset()
 		wg.Add(1)
 		go (func() {
 			defer wg.Done()
-			err := handleClient(ctx, wg, &SimpleIPCClientCnx{cnx.(*net.UnixConn), clientList}, cjdroute, peer)
+			defer cnx.Close()
+			err := serveClient(ctx, wg, &SimpleIPCClientCnx{cnx: cnx.(*net.UnixConn), offered: srv.Capabilities()}, srv)
 			if err != nil {
-				log.Print(err)
+				slog.Error("Client connection failed", "err", err)
 			}
 		})()
 	}
@@ -186,6 +388,189 @@ func run(ctx0 context.Context, wg *sync.WaitGroup, cjdroute, sockPath string, pe
 	return nil
 }
 
+// Dispatch a client connection depending on its first message
+func serveClient(ctx context.Context, wg *sync.WaitGroup, c *SimpleIPCClientCnx, srv *Server) error {
+	h, payload, err := c.receiveMessage()
+	if err != nil {
+		c.SendError(err)
+		return err
+	}
+
+	switch h.Seq {
+	case cjdnserver.InitialRequest:
+		c.request = h
+		c.requestPayload = payload
+		// handleClient logs its own errors with the instance context
+		handleClient(ctx, wg, c, srv)
+		return nil
+	case cjdnserver.Release:
+		return handleRelease(ctx, c, h, srv.Clients)
+	case cjdnserver.Subscribe:
+		return handleSubscribe(ctx, c, h, srv.Clients)
+	case cjdnserver.Resume:
+		return handleResume(ctx, c, payload, srv.Clients)
+	case cjdnserver.Health:
+		return handleHealth(c, h, srv.Clients)
+	default:
+		err = cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Received unknown message from client %d", h.Seq)
+		c.SendError(err)
+		return err
+	}
+}
+
+// Stop the instance in the network namespace sent by the client and confirm
+// once it is terminated
+func handleRelease(ctx context.Context, c *SimpleIPCClientCnx, h *simpleipc.Header, clientList *ClientList) error {
+	ino, err := netnsInode(h)
+	if err != nil {
+		c.SendError(err)
+		return err
+	}
+
+	inst := clientList.Get(ino)
+	if inst == nil {
+		err = cjdnserver.NewError(cjdnserver.ErrCodeNotFound, "No instance for network namespace %d", ino)
+		c.SendError(err)
+		return err
+	}
+
+	inst.Logger().Info("Release network namespace")
+	inst.Cancel()
+	select {
+	case <-inst.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	h = simpleipc.NewHeader(cjdnserver.Released, 0, nil)
+	return h.Write(c.cnx)
+}
+
+// Report the health of the instance in the network namespace sent by the
+// client
+func handleHealth(c *SimpleIPCClientCnx, h *simpleipc.Header, clientList *ClientList) error {
+	ino, err := netnsInode(h)
+	if err != nil {
+		c.SendError(err)
+		return err
+	}
+
+	inst := clientList.Get(ino)
+	if inst == nil {
+		err = cjdnserver.NewError(cjdnserver.ErrCodeNotFound, "No instance for network namespace %d", ino)
+		c.SendError(err)
+		return err
+	}
+
+	h = simpleipc.NewHeader(cjdnserver.HealthResponse, 0, nil)
+	return cjdnserver.WriteJSON(c.cnx, h, inst.Health())
+}
+
+// Stream the events of the instance in the network namespace sent by the
+// client until either the instance or the connection is closed
+func handleSubscribe(ctx context.Context, c *SimpleIPCClientCnx, h *simpleipc.Header, clientList *ClientList) error {
+	ino, err := netnsInode(h)
+	if err != nil {
+		c.SendError(err)
+		return err
+	}
+
+	inst := clientList.Get(ino)
+	if inst == nil {
+		err = cjdnserver.NewError(cjdnserver.ErrCodeNotFound, "No instance for network namespace %d", ino)
+		c.SendError(err)
+		return err
+	}
+
+	inst.Subscribe(c)
+	defer inst.Unsubscribe(c)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ioutil.ReadAll(c.cnx)
+	}()
+
+	select {
+	case <-inst.Done:
+	case <-closed:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// Return the inode of the network namespace file descriptor passed with the
+// message
+func netnsInode(h *simpleipc.Header) (uint64, error) {
+	if len(h.Files) == 0 {
+		return 0, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Did not received any file descriptor")
+	}
+	defer h.Files[0].Close()
+	st, err := h.Files[0].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// Delay between failed Accept calls, doubled up to a second so persistent
+// errors such as EMFILE do not make the accept loops spin
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// Log the Accept error and wait before the next try, unless the context is
+// cancelled
+func (b *acceptBackoff) Wait(ctx context.Context, msg string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else if b.delay *= 2; b.delay > time.Second {
+		b.delay = time.Second
+	}
+	slog.Error(msg, "err", err, "retry", b.delay)
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func (b *acceptBackoff) Reset() {
+	b.delay = 0
+}
+
+// Create a unix socket, replacing any existing file, and set its permissions
+func listenUnix(sockPath string, perms os.FileMode) (net.Listener, error) {
+	err := os.MkdirAll(path.Dir(sockPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(sockPath)
+	if err == nil {
+		slog.Info("Remove existing socket", "path", sockPath)
+		err = os.Remove(sockPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("Listen", "path", sockPath)
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Chmod socket", "path", sockPath, "perms", "0"+strconv.FormatInt(int64(perms), 8))
+	err = os.Chmod(sockPath, perms)
+	if err != nil {
+		slog.Warn("Chmod socket", "path", sockPath, "err", err)
+	}
+	return l, nil
+}
+
 func parseAdminAddr(addr string) (string, int) {
 	i := strings.Index(addr, ":")
 	port, _ := strconv.ParseInt(addr[i+1:], 10, 32)
@@ -193,44 +578,136 @@ func parseAdminAddr(addr string) (string, int) {
 }
 
 type SimpleIPCClientCnx struct {
-	cnx        *net.UnixConn
-	clientList *ClientList
+	cnx *net.UnixConn
+	// Capabilities offered by the server
+	offered      []string
+	version      int
+	capabilities []string
+	refused      bool
+	wlock        sync.Mutex
+	// First message after the handshake, when it is an initial request
+	request        *simpleipc.Header
+	requestPayload []byte
 }
 
-func (c *SimpleIPCClientCnx) ReceivePrivKey() (*key.Private, *os.File, error) {
+// Handle the Hello message and reply with the negotiated protocol version and
+// capabilities. Return an error if the client is refused.
+func (c *SimpleIPCClientCnx) handshake(payload []byte) error {
+	var hello cjdnserver.HelloMessage
+	var reply *cjdnserver.HelloReply
+	err := json.Unmarshal(payload, &hello)
+	if err != nil {
+		reply = &cjdnserver.HelloReply{
+			Version: cjdnserver.ProtocolVersion,
+			Error:   fmt.Sprintf("invalid hello message: %v", err),
+		}
+	} else {
+		reply = cjdnserver.Negotiate(&hello, c.offered)
+	}
+
+	h := simpleipc.NewHeader(cjdnserver.HelloResponse, 0, nil)
+	err = cjdnserver.WriteJSON(c.cnx, h, reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		c.refused = true
+		return cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Refused client: %s", reply.Error)
+	}
+
+	slog.Debug("Client hello", "version", reply.Version, "capabilities", reply.Capabilities)
+	c.version = reply.Version
+	c.capabilities = reply.Capabilities
+	return nil
+}
+
+// Receive the first message from the client, handling the handshake if the
+// client starts with a Hello message
+func (c *SimpleIPCClientCnx) receiveMessage() (*simpleipc.Header, []byte, error) {
 	h := new(simpleipc.Header)
-	privkey, err := h.ReadWithPayload(c.cnx, nil)
+	payload, err := h.ReadWithPayload(c.cnx, nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	var skey *key.Private
-	if len(privkey) > 0 {
-		skey = new(key.Private)
-		if len(privkey) == len(*skey) {
-			copy(skey[:], privkey)
+	if h.Seq == cjdnserver.Hello {
+		err = c.handshake(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		h = new(simpleipc.Header)
+		payload, err = h.ReadWithPayload(c.cnx, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return h, payload, nil
+}
+
+func (c *SimpleIPCClientCnx) ReceiveRequest() (*ClientRequest, error) {
+	h, payload := c.request, c.requestPayload
+	if h == nil {
+		return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Did not receive initial request")
+	}
+	req := new(ClientRequest)
+	if cjdnserver.HasCapability(c.capabilities, cjdnserver.CapOptions) {
+		req.Options = new(cjdnserver.InitialMessage)
+		err := json.Unmarshal(payload, req.Options)
+		if err != nil {
+			return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Invalid initial request: %v", err)
+		}
+		if req.Options.PrivateKey != "" {
+			req.SKey, err = key.DecodePrivate(req.Options.PrivateKey)
+			if err != nil {
+				return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Invalid private key: %v", err)
+			}
+		}
+	} else if len(payload) > 0 {
+		req.SKey = new(key.Private)
+		if len(payload) == len(*req.SKey) {
+			copy(req.SKey[:], payload)
 		} else {
-			skey = nil
+			req.SKey = nil
 		}
 	}
-	log.Printf("Received header %#v", h)
+	if req.SKey != nil && !req.SKey.Valid() {
+		return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Invalid private key")
+	}
+	slog.Debug("Received header", "header", h)
 	if len(h.Files) == 0 {
-		return nil, nil, fmt.Errorf("Did not received any file descriptor")
+		return nil, cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Did not received any file descriptor")
 	}
-	st, err := h.Files[0].Stat()
-	if err != nil {
-		return nil, nil, err
+	req.NetNs = h.Files[0]
+	return req, nil
+}
+
+func (c *SimpleIPCClientCnx) SendInitialResponse(reply *cjdnserver.InitialReply) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	h := simpleipc.NewHeader(cjdnserver.InitialResponse, 0, nil)
+	if !cjdnserver.HasCapability(c.capabilities, cjdnserver.CapInterfaceInfo) {
+		return h.Write(c.cnx)
 	}
-	ns_ino := st.Sys().(*syscall.Stat_t).Ino
-	err = c.clientList.Add(ns_ino, c)
-	if err != nil {
-		return nil, nil, err
+	return cjdnserver.WriteJSON(c.cnx, h, reply)
+}
+
+func (c *SimpleIPCClientCnx) SendError(err error) error {
+	if c.refused || !cjdnserver.HasCapability(c.capabilities, cjdnserver.CapErrors) {
+		return nil
 	}
-	return skey, h.Files[0], nil
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	h := simpleipc.NewHeader(cjdnserver.ErrorResponse, 0, nil)
+	return cjdnserver.WriteJSON(c.cnx, h, cjdnserver.AsError(err))
 }
 
-func (c *SimpleIPCClientCnx) SendInitialResponse() error {
-	h := simpleipc.NewHeader(cjdnserver.InitialResponse, 0, nil)
-	return h.Write(c.cnx)
+func (c *SimpleIPCClientCnx) SendEvent(ev *cjdnserver.EventMessage) error {
+	if !cjdnserver.HasCapability(c.capabilities, cjdnserver.CapEvents) {
+		return nil
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	h := simpleipc.NewHeader(cjdnserver.Event, 0, nil)
+	return cjdnserver.WriteJSON(c.cnx, h, ev)
 }
 
 func (c *SimpleIPCClientCnx) ReceivePing(ctx context.Context) (error, bool) {
@@ -245,13 +722,32 @@ func (c *SimpleIPCClientCnx) ReceivePing(ctx context.Context) (error, bool) {
 	}
 }
 
+// Request received from a client
+type ClientRequest struct {
+	// Secret key (or nil, it is optional)
+	SKey *key.Private
+	// File corresponding to the network namespace file descriptor
+	NetNs *os.File
+	// Interface options requested by the client (or nil)
+	Options *cjdnserver.InitialMessage
+	// The network namespace was detected, there is no client connection
+	Detected bool
+}
+
 type ClientCnx interface {
-	// Return a secret key (or nil, it is optional), a file corresponding to the
-	// network namespace file descriptor and an error
-	ReceivePrivKey() (*key.Private, *os.File, error)
+	// Return the client request, with the network namespace to create the
+	// interface into
+	ReceiveRequest() (*ClientRequest, error)
+
+	// Unlock the client side when the cjdns interface is ready and tell it the
+	// interface details
+	SendInitialResponse(reply *cjdnserver.InitialReply) error
 
-	// Unlock the client side when the cjdns interface is ready
-	SendInitialResponse() error
+	// Tell the client why it cannot be served
+	SendError(err error) error
+
+	// Push an event about the instance to the client
+	SendEvent(ev *cjdnserver.EventMessage) error
 
 	// Wait and return when the client sends a watchdog ping. Return an error and
 	// a boolean indicating if the error is fatal or not.
@@ -267,11 +763,23 @@ type DetectedNamespace struct {
 	Mark     bool
 }
 
-func (ns *DetectedNamespace) ReceivePrivKey() (*key.Private, *os.File, error) {
-	return nil, ns.File, nil
+func (ns *DetectedNamespace) ReceiveRequest() (*ClientRequest, error) {
+	return &ClientRequest{
+		SKey:     ns.SKey,
+		NetNs:    ns.File,
+		Detected: true,
+	}, nil
+}
+
+func (ns *DetectedNamespace) SendInitialResponse(reply *cjdnserver.InitialReply) error {
+	return nil
+}
+
+func (ns *DetectedNamespace) SendError(err error) error {
+	return nil
 }
 
-func (ns *DetectedNamespace) SendInitialResponse() error {
+func (ns *DetectedNamespace) SendEvent(ev *cjdnserver.EventMessage) error {
 	return nil
 }
 
@@ -290,52 +798,143 @@ func mark(list map[uint64]*DetectedNamespace) {
 	}
 }
 
-func sweep(clientList *ClientList, list map[uint64]*DetectedNamespace) {
+func sweep(list map[uint64]*DetectedNamespace) {
 	for ino, ns := range list {
 		if ns.Mark {
 			ns.Cancel()
 			delete(list, ino)
-			clientList.Remove(ino)
 		}
 	}
 }
 
+// Running cjdns instance for a network namespace
+type Instance struct {
+	sync.Mutex
+	Ino    uint64
+	Cnx    ClientCnx
+	Cancel context.CancelFunc
+	// Closed when cjdroute is terminated and the instance cleaned up
+	Done      chan struct{}
+	IPv6      string
+	PublicKey string
+	AdminPort int
+	Pid       int
+	Started   time.Time
+	Restarts  int
+	Tmpdir    string
+	SockPath  string
+	Conf      *Conf
+	AdminConf admin.CjdnsAdminConfig
+	TunFd     *os.File
+	Reply     *cjdnserver.InitialReply
+	Settings  InterfaceSettings
+	// Cgroup of cjdroute, empty if not using cgroups
+	Cgroup string
+	Log    *InstanceLog
+	// Standard output and error of cjdroute, and the server end
+	output       *os.File
+	outputReader *os.File
+	// Receives restart requests for cjdroute
+	restart chan struct{}
+	// Receives the client watchdog pings
+	ping        chan struct{}
+	subscribers []ClientCnx
+	// The initial response was sent to the client
+	responded bool
+	lastPing  time.Time
+	// Number of peers and established peer sessions, valid once peerStats is
+	// true: the peer stats were read since cjdroute started
+	peers       int
+	established int
+	peerStats   bool
+	state       string
+	// Times cjdroute was restarted by the restart policy
+	recentRestarts []time.Time
+	// Upstream peers in the cjdroute configuration
+	upstream []Peer
+	// The instance was created for a detected network namespace
+	detected bool
+	// cjdroute is left running when the server shuts down
+	detached     bool
+	pidStartTime uint64
+}
+
 type ClientList struct {
 	sync.Mutex
-	Ns map[uint64]ClientCnx
+	Ns  map[uint64]*Instance
+	Max int
+	// Receives a value when instances are added or removed
+	Changed chan struct{}
 }
 
-var ErrExists error = fmt.Errorf("Namespace already exists")
+var ErrExists error = cjdnserver.NewError(cjdnserver.ErrCodeDuplicateNamespace, "Namespace already exists")
+var ErrQuota error = cjdnserver.NewError(cjdnserver.ErrCodeQuotaExceeded, "Maximum number of instances reached")
 
-func NewClientList() *ClientList {
+func NewClientList(max int) *ClientList {
 	return &ClientList{
-		Ns: map[uint64]ClientCnx{},
+		Ns:      map[uint64]*Instance{},
+		Max:     max,
+		Changed: make(chan struct{}, 1),
 	}
 }
 
-func (cl *ClientList) Remove(ns_ino uint64) {
+func (cl *ClientList) changed() {
+	select {
+	case cl.Changed <- struct{}{}:
+	default:
+	}
+}
+
+func (cl *ClientList) Remove(inst *Instance) {
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.Ns[inst.Ino] == inst {
+		delete(cl.Ns, inst.Ino)
+		cl.changed()
+	}
+}
+
+func (cl *ClientList) Get(ns_ino uint64) *Instance {
+	cl.Lock()
+	defer cl.Unlock()
+	return cl.Ns[ns_ino]
+}
+
+// Find the instance with the given session token
+func (cl *ClientList) FindSession(session string) *Instance {
 	cl.Lock()
 	defer cl.Unlock()
-	delete(cl.Ns, ns_ino)
+	for _, inst := range cl.Ns {
+		inst.Lock()
+		found := session != "" && inst.Reply != nil && subtle.ConstantTimeCompare([]byte(inst.Reply.Session), []byte(session)) == 1
+		inst.Unlock()
+		if found {
+			return inst
+		}
+	}
+	return nil
 }
 
-func (cl *ClientList) Add(ns_ino uint64, c ClientCnx) error {
+func (cl *ClientList) Add(inst *Instance) error {
 	cl.Lock()
 	defer cl.Unlock()
-	if _, ok := cl.Ns[ns_ino]; ok {
+	if _, ok := cl.Ns[inst.Ino]; ok {
 		return ErrExists
+	} else if cl.Max > 0 && len(cl.Ns) >= cl.Max {
+		return ErrQuota
 	} else {
-		cl.Ns[ns_ino] = c
+		cl.Ns[inst.Ino] = inst
+		cl.changed()
 		return nil
 	}
 }
 
-func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *ClientList, cjdroute string, peer *Peer) error {
-	nsList := map[uint64]*DetectedNamespace{}
-
+// Detect network namespaces of containers and create instances for them.
+// nsList contains the detected namespaces of adopted instances.
+func detectProcesses(ctx context.Context, wg *sync.WaitGroup, srv *Server, nsList map[uint64]*DetectedNamespace) error {
 	for ctx.Err() == nil {
 		mark(nsList)
-		//log.Printf("Detect new network namespaces...")
+		slog.Debug("Detect new network namespaces")
 
 		selfNsSt, err := os.Stat("/proc/self/ns/net")
 		if err != nil {
@@ -347,14 +946,13 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 		if err != nil {
 			return err
 		}
-		defer proc.Close()
-
 		pids, err := proc.Readdirnames(-1)
+		proc.Close()
 		if err != nil {
 			return err
 		}
 		for _, pidName := range pids {
-			//log.Printf("Detect new network namespaces... pid %s", pidName)
+			slog.Debug("Detect network namespace", "pid", pidName)
 			pid, err := strconv.Atoi(pidName)
 			if err != nil {
 				continue
@@ -362,7 +960,7 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 			netnsName := fmt.Sprintf("/proc/%s/ns/net", pidName)
 			se, err := os.Stat(netnsName)
 			if err != nil {
-				//log.Printf("%s: %v", netnsName, err)
+				slog.Debug("Stat network namespace", "path", netnsName, "err", err)
 				continue
 			}
 			inode := se.Sys().(*syscall.Stat_t).Ino
@@ -371,7 +969,7 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 			}
 			ppid, err := GetPPidOf(pid)
 			if err != nil {
-				log.Printf("/proc/%s/status: %v", pidName, err)
+				slog.Warn("Read parent pid", "pid", pidName, "err", err)
 				continue
 			}
 			if ppid == 0 {
@@ -381,40 +979,58 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 			ppidnsName := fmt.Sprintf("/proc/%d/ns/pid", ppid)
 			pidnsSt, err := os.Stat(pidnsName)
 			if err != nil {
-				log.Printf("%s: %v", pidnsName, err)
+				slog.Warn("Stat pid namespace", "path", pidnsName, "err", err)
 				continue
 			}
 			ppidnsSt, err := os.Stat(ppidnsName)
 			if err != nil {
-				log.Printf("%s: %v", ppidnsName, err)
+				slog.Warn("Stat pid namespace", "path", ppidnsName, "err", err)
 				continue
 			}
 			if pidnsSt.Sys().(*syscall.Stat_t).Ino == ppidnsSt.Sys().(*syscall.Stat_t).Ino {
 				continue // the process is not the init process of a container
 			}
+			if len(srv.DetectIgnore) > 0 {
+				comm, err := GetCommOf(pid)
+				if err != nil {
+					slog.Warn("Read command name", "pid", pid, "err", err)
+					continue
+				} else if srv.ignored(comm) {
+					slog.Debug("Ignore process", "pid", pid, "comm", comm)
+					continue
+				}
+			}
 			nsFile, err := os.Open(netnsName)
 			if err != nil {
-				log.Printf("%s: %v", netnsName, err)
+				slog.Warn("Open network namespace", "path", netnsName, "err", err)
 				continue
 			}
 			skeystr, err := GetEnvironOf(pid, "CJDNS_PRIVKEY")
 			if err != nil {
-				log.Printf("/proc/%d/environ: %v", pid, err)
+				slog.Warn("Read environment", "pid", pid, "err", err)
+				nsFile.Close()
 				continue
 			}
 			var skey *key.Private
 			if skeystr != "" {
 				skey, err = key.DecodePrivate(skeystr)
 				if err != nil {
-					log.Printf("parse secret key: %v", netnsName, err)
+					slog.Warn("Parse CJDNS_PRIVKEY", "pid", pid, "netns", inode, "err", err)
+					nsFile.Close()
 					continue
 				}
 			}
 			if ns, ok := nsList[inode]; ok {
 				ns.Mark = false
-				ns.Watchdog <- struct{}{}
+				nsFile.Close()
+				select {
+				case ns.Watchdog <- struct{}{}:
+				default: // the instance is stopped or released
+				}
+			} else if srv.Clients.Get(inode) != nil {
+				nsFile.Close() // served by a client connection
 			} else {
-				log.Printf("New network namespace for pid %s: %d", pidName, inode)
+				slog.Info("New network namespace", "pid", pid, "netns", inode)
 				nsCtx, nsCancel := context.WithCancel(ctx)
 				ns := &DetectedNamespace{
 					Ino:      inode,
@@ -423,23 +1039,16 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 					Cancel:   nsCancel,
 					Watchdog: make(chan struct{}, 0),
 				}
-				if err := clientList.Add(inode, ns); err != nil {
-					log.Print(err)
-				} else {
-					nsList[inode] = ns
-					wg.Add(1)
-					go (func() {
-						defer wg.Done()
-						err := handleClient(nsCtx, wg, ns, cjdroute, peer)
-						if err != nil {
-							log.Print(err)
-						}
-					})()
-				}
+				nsList[inode] = ns
+				wg.Add(1)
+				go (func() {
+					defer wg.Done()
+					handleClient(nsCtx, wg, ns, srv)
+				})()
 			}
 		}
 
-		sweep(clientList, nsList)
+		sweep(nsList)
 
 		tmout, _ := context.WithTimeout(ctx, time.Second)
 		<-tmout.Done()
@@ -447,158 +1056,446 @@ func detectProcesses(ctx context.Context, wg *sync.WaitGroup, clientList *Client
 	return nil
 }
 
-func handleClient(ctx0 context.Context, wg *sync.WaitGroup, cnx ClientCnx, cjdroute string, peer *Peer) error {
+func handleClient(ctx0 context.Context, wg *sync.WaitGroup, cnx ClientCnx, srv *Server) (err error) {
 	ctx, cancel := context.WithCancel(ctx0)
 
+	var inst *Instance
+	defer func() {
+		if err != nil {
+			logger := slog.Default()
+			if inst != nil {
+				logger = inst.Logger()
+			}
+			logger.Error("Instance failed", "err", err)
+		}
+		if err != nil && (inst == nil || !inst.responded) {
+			if err2 := cnx.SendError(err); err2 != nil {
+				slog.Warn("Send error to client", "err", err2)
+			}
+		}
+	}()
+
 	adminif, err := reuseport.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
 		return err
 	}
 	adminaddr := adminif.LocalAddr().String()
-	log.Printf("Listen to admin %v", adminaddr)
-	var adminConf admin.CjdnsAdminConfig
-	adminConf.Addr, adminConf.Port = parseAdminAddr(adminaddr)
+	slog.Debug("Listen to admin", "addr", adminaddr)
 	defer adminif.Close()
 
-	skey, tunfile, err := cnx.ReceivePrivKey()
+	req, err := cnx.ReceiveRequest()
 	if err != nil {
 		return err
 	}
 
+	st, err := req.NetNs.Stat()
+	if err != nil {
+		return err
+	}
+	inst = &Instance{
+		Ino:      st.Sys().(*syscall.Stat_t).Ino,
+		Cnx:      cnx,
+		Cancel:   cancel,
+		Done:     make(chan struct{}),
+		Started:  time.Now(),
+		restart:  make(chan struct{}, 1),
+		ping:     make(chan struct{}),
+		detected: req.Detected,
+	}
+	inst.AdminConf.Addr, inst.AdminConf.Port = parseAdminAddr(adminaddr)
+	err = srv.Clients.Add(inst)
+	if err != nil {
+		return err
+	}
+	defer srv.cleanup(inst)
+
+	logger := inst.Logger()
+	settings, accepted, rejected := srv.Policy.Apply(req.Options)
+	for _, r := range rejected {
+		logger.Info("Rejected client option", "reason", r)
+	}
+
 	suffix := ""
-	if skey != nil {
-		suffix = "-" + skey.Pubkey().IP().String()
+	if req.SKey != nil {
+		suffix = "-" + req.SKey.Pubkey().IP().String()
+	}
+	inst.Tmpdir, err = ioutil.TempDir("", "cjdnserver-client"+suffix)
+	if err != nil {
+		return err
+	}
+	logger.Info("Receive client", "tmpdir", inst.Tmpdir)
+	tundir := path.Join(inst.Tmpdir, "tun")
+	err = os.Mkdir(tundir, 0700)
+	if err != nil {
+		return err
 	}
-	tmpdir, err := ioutil.TempDir("", "cjdnserver-client"+suffix)
+	err = srv.Sandbox.Chown(inst.Tmpdir, tundir)
+	if err != nil {
+		return err
+	}
+	instLog, err := NewInstanceLog(srv.LogDir, inst.Ino, srv.LogMaxSize, srv.LogBackups)
+	if err != nil {
+		return err
+	}
+	// The instance is already listed, the control socket may read its log
+	inst.Lock()
+	inst.Log = instLog
+	inst.Unlock()
+	err = inst.openOutput()
 	if err != nil {
 		return err
 	}
-	log.Printf("Receive client in %v", tmpdir)
-	defer os.RemoveAll(tmpdir)
 
-	sockpath := path.Join(tmpdir, "cjdnstun.socket")
-	conf, ipv6, adminpass, err := Genconf(cjdroute, sockpath, adminaddr, peer, skey)
-	adminConf.Password = adminpass
+	inst.SockPath = path.Join(tundir, "cjdnstun.socket")
+	upstream := srv.UpstreamPeers()
+	conf, err := Genconf(srv.Cjdroute, inst.SockPath, adminaddr, upstream, settings.Peers, req.SKey)
 	if err != nil {
 		return err
 	}
+	inst.Lock()
+	inst.Conf = conf
+	inst.Settings = settings
+	inst.upstream = upstream
+	inst.IPv6 = conf.IPv6
+	inst.PublicKey = conf.PublicKey
+	inst.Unlock()
+	logger = inst.Logger()
+	if srv.CgroupParent != "" {
+		inst.Cgroup = CgroupPath(srv.CgroupParent, inst.Ino)
+		err = MakeCgroup(logger, inst.Cgroup, &settings.Limits)
+		if err != nil {
+			return fmt.Errorf("cgroup %s: %v", inst.Cgroup, err)
+		}
+	}
+	inst.AdminConf.Password = conf.AdminPassword
+
+	inst.Reply = &cjdnserver.InitialReply{
+		IPv6:      conf.IPv6,
+		PublicKey: conf.PublicKey,
+		Interface: settings.Name,
+		PrefixLen: InterfacePrefixLen,
+		MTU:       settings.MTU,
+		Routes:    settings.Routes,
+		Accepted:  accepted,
+		Rejected:  rejected,
+
+		WatchdogInterval: int(settings.WatchdogInterval / time.Second),
+		WatchdogTimeout:  int(settings.WatchdogTimeout / time.Second),
+	}
+	if !req.Detected {
+		inst.Reply.Session = genpass.Generate(32)
+	}
+	for _, p := range append(append([]Peer{}, upstream...), settings.Peers...) {
+		inst.Reply.Peers = append(inst.Reply.Peers, cjdnserver.PeerInfo{
+			Address:   p.Address,
+			PublicKey: p.Pubkey,
+		})
+	}
 
-	conffile := path.Join(tmpdir, "cjdroute.conf")
-	err = ioutil.WriteFile(conffile, []byte(conf), 0644)
+	conffile := path.Join(inst.Tmpdir, "cjdroute.conf")
+	err = ioutil.WriteFile(conffile, []byte(conf.Data), 0644)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Admin interface ip %s port %d password %#v", adminConf.Addr, adminConf.Port, adminConf.Password)
-	log.Printf("Configuration file written to %s", conffile)
-	log.Print(conf)
+	logger.Debug("Admin interface", "addr", inst.AdminConf.Addr, "port", inst.AdminConf.Port, "password", inst.AdminConf.Password)
+	logger.Debug("Configuration file written", "path", conffile, "conf", conf.Data)
 
-	tunfd, err := MakeTunInNs(tunfile, ipv6, InterfaceMTU)
+	inst.TunFd, err = MakeTunInNs(req.NetNs, settings.Name, conf.IPv6, settings.MTU, settings.Routes)
 	if err != nil {
-		return err
+		return cjdnserver.NewError(cjdnserver.ErrCodeTunDevice, "Could not create tun device: %v", err)
 	}
-	defer tunfd.Close()
+
+	return runInstance(ctx, wg, inst, srv, nil)
+}
+
+// Run cjdroute for the instance and restart it until the context is cancelled.
+// If process is not nil, it is a cjdroute process adopted from a previous
+// server and it is watched instead of starting a new one.
+func runInstance(ctx context.Context, wg *sync.WaitGroup, inst *Instance, srv *Server, process *os.Process) error {
+	var err error
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		receiveWatchdog(ctx, wg, cancel, cnx)
+		receiveWatchdog(ctx, wg, inst)
 	}()
 
 	for ctx.Err() == nil {
 		instanceCtx, instanceStop := context.WithCancel(ctx)
-		log.Printf("Start cjdroute")
-		process, err := Start(cjdroute, conf)
-		if err != nil {
-			return err
-		}
-
-		go (func() {
-			cnxtun, err := SendTunDev(sockpath, tunfd)
+		cstate := make(chan *os.ProcessState, 1)
+		cerr := make(chan error, 1)
+
+		// The upstream peers may change the configuration between restarts
+		inst.Lock()
+		conf := inst.Conf
+		inst.Unlock()
+
+		logger := inst.Logger()
+		adopted := process != nil
+		if adopted {
+			logger.Info("Adopt cjdroute", "pid", process.Pid)
+			// Keep watching while cjdroute is stopped, until the instance
+			// context is released
+			waitCtx, waitStop := context.WithCancel(context.Background())
+			stop := instanceStop
+			instanceStop = func() {
+				stop()
+				waitStop()
+			}
+			go waitAdopted(waitCtx, process.Pid, inst.pidStartTime, cstate)
+		} else if inst.TunFd == nil {
+			instanceStop()
+			return fmt.Errorf("Cannot restart cjdroute without tun device")
+		} else {
+			logger.Info("Start cjdroute")
+			process, err = Start(srv.Cjdroute, conf.Data, inst.Cgroup, srv.Sandbox, inst.output)
 			if err != nil {
-				log.Print(err)
+				instanceStop()
+				if !inst.responded {
+					return err
+				}
+				logger.Error("Start cjdroute", "err", err)
+				if !inst.waitRestart(ctx, srv.Restart, true, false) {
+					break
+				}
+				continue
 			}
-			defer cnxtun.Close()
-			<-instanceCtx.Done()
-		})()
+			inst.pidStartTime, err = GetStartTimeOf(process.Pid)
+			if err != nil {
+				logger.Warn("Read process start time", "pid", process.Pid, "err", err)
+			}
+		}
+		inst.Lock()
+		inst.Pid = process.Pid
+		inst.Unlock()
+		logger = inst.Logger()
+
+		if !adopted {
+			go (func() {
+				cnxtun, err := SendTunDev(logger, inst.SockPath, inst.TunFd)
+				if err != nil {
+					logger.Error("Send tun device", "err", err)
+					return
+				}
+				defer cnxtun.Close()
+				<-instanceCtx.Done()
+			})()
 
-		err = cnx.SendInitialResponse()
-		if err != nil {
-			return err
+			// Not in the wait group: a detached cjdroute outlives the server
+			go func(process *os.Process) {
+				state, err := process.Wait()
+				if err != nil {
+					cerr <- err
+				} else {
+					cstate <- state
+				}
+			}(process)
+
+			if inst.responded {
+				inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventRestarted, IPv6: conf.IPv6})
+			}
 		}
 
-		cstate := make(chan *os.ProcessState)
-		cerr := make(chan error)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			state, err := process.Wait()
+		if !inst.responded {
+			if inst.Settings.WaitConnected {
+				inst.Reply.Connected = waitConnected(instanceCtx, &inst.AdminConf, inst.Settings.WaitTarget, inst.Settings.WaitTimeout)
+				if !inst.Reply.Connected {
+					instanceStop()
+					stopProcess(logger, srv.Stop, &inst.AdminConf, process, cstate, cerr)
+					return cjdnserver.NewError(cjdnserver.ErrCodeNotConnected, "Instance not connected after %v", inst.Settings.WaitTimeout)
+				}
+			}
+			err = inst.Cnx.SendInitialResponse(inst.Reply)
 			if err != nil {
-				cerr <- err
-			} else {
-				cstate <- state
+				instanceStop()
+				return err
 			}
-		}()
-
+			inst.Lock()
+			inst.responded = true
+			inst.Unlock()
+		}
+		// Events must not reach the client before the initial response
+		go monitorPeers(instanceCtx, inst, &inst.AdminConf)
+
+		inst.Lock()
+		inst.IPv6 = conf.IPv6
+		inst.PublicKey = conf.PublicKey
+		inst.AdminPort = inst.AdminConf.Port
+		inst.state = StateRunning
+		inst.Unlock()
+		srv.saveState(inst)
+
+		failed := false
+		requested := false
 		select {
 		case <-ctx.Done():
-			log.Printf("Send Core_exit()")
-			adm, err := admin.Connect(&adminConf)
+			if srv.detaching() {
+				logger.Info("Leave cjdroute running for the next server")
+				inst.detached = true
+				instanceStop()
+				return nil
+			}
+			inst.Emit(&cjdnserver.EventMessage{Type: cjdnserver.EventShuttingDown, IPv6: conf.IPv6})
+			err = stopProcess(logger, srv.Stop, &inst.AdminConf, process, cstate, cerr)
 			if err != nil {
-				return fmt.Errorf("connect to admin interface: %v", err)
+				instanceStop()
+				return err
 			}
-			err = adm.Core_exit()
+		case <-inst.restart:
+			logger.Info("Restart requested")
+			requested = true
+			err = stopProcess(logger, srv.Stop, &inst.AdminConf, process, cstate, cerr)
 			if err != nil {
-				log.Printf("Core_exit: %v", err)
+				instanceStop()
+				return err
 			}
-			log.Printf("Send SIGTERM to cjdroute")
-			process.Signal(syscall.SIGTERM)
 		case err := <-cerr:
-			log.Printf("Error: %s", err)
+			logger.Error("cjdroute failed", "err", err)
+			failed = true
 		case state := <-cstate:
-			log.Printf("Terminated: %s", state.String())
+			if state == nil {
+				logger.Warn("cjdroute terminated")
+			} else {
+				logger.Warn("cjdroute terminated", "state", state.String())
+				failed = !state.Success()
+			}
 		}
 		instanceStop()
+		process = nil
+
+		inst.Lock()
+		inst.Pid = 0
+		inst.peers = 0
+		inst.established = 0
+		inst.peerStats = false
+		inst.Unlock()
+
+		if ctx.Err() != nil || !inst.waitRestart(ctx, srv.Restart, failed, requested) {
+			break
+		}
 	}
 
-	log.Printf("Stopped %s", ipv6)
+	inst.Logger().Info("Stopped")
 
 	return nil
 }
 
-func receiveWatchdog(ctx0 context.Context, wg *sync.WaitGroup, cancel context.CancelFunc, cnx ClientCnx) {
+func receiveWatchdog(ctx0 context.Context, wg *sync.WaitGroup, inst *Instance) {
 	ctx, cancel2 := context.WithCancel(ctx0)
-	ping := make(chan struct{})
-	//wg.Add(1)
-	go func() {
-		//defer wg.Done()
-		for ctx.Err() == nil {
-			err, fatal := cnx.ReceivePing(ctx)
-			if err != nil {
-				log.Print(err)
-				if fatal {
-					log.Printf("Watchdog triggered stop")
-					cancel()
-					cancel2()
-				}
-			} else {
-				ping <- struct{}{}
-			}
-		}
-	}()
+	defer cancel2()
+	go receivePings(ctx, inst, inst.Cnx)
 	for ctx.Err() == nil {
-		timeout, _ := context.WithTimeout(ctx, time.Minute)
+		timeout, _ := context.WithTimeout(ctx, inst.watchdogTimeout())
 		select {
 		case <-timeout.Done():
-			log.Printf("Watchdog triggered stop")
-			cancel()
+			if ctx.Err() == nil {
+				inst.Logger().Warn("Watchdog triggered stop", "timeout", inst.watchdogTimeout())
+			}
+			inst.Cancel()
 			cancel2()
-		case <-ping:
+		case <-inst.ping:
+			inst.Lock()
+			inst.lastPing = time.Now()
+			inst.Unlock()
+		}
+	}
+}
+
+// Time without pings after which the instance is stopped
+func (inst *Instance) watchdogTimeout() time.Duration {
+	if inst.Reply == nil || inst.Reply.WatchdogTimeout == 0 {
+		return WatchdogTimeout
+	}
+	return time.Duration(inst.Reply.WatchdogTimeout) * time.Second
+}
+
+// Forward the watchdog pings received on the client connection to the
+// instance. When the connection is lost, stop the instance unless the client
+// can resume its session on a new connection.
+func receivePings(ctx context.Context, inst *Instance, cnx ClientCnx) {
+	for ctx.Err() == nil {
+		err, fatal := cnx.ReceivePing(ctx)
+		if err != nil {
+			logger := inst.Logger()
+			logger.Warn("Receive watchdog ping", "err", err)
+			if fatal && resumable(cnx) {
+				logger.Info("Lost client connection, waiting for the session to resume")
+				return
+			} else if fatal {
+				logger.Warn("Watchdog triggered stop")
+				inst.Cancel()
+				return
+			}
+		} else if ctx.Err() == nil {
+			slog.Debug("Received watchdog ping", "netns", inst.Ino)
+			select {
+			case inst.ping <- struct{}{}:
+			case <-ctx.Done():
+			}
 		}
 	}
 }
 
-func SendTunDev(sockPath string, tunfd *os.File) (net.Conn, error) {
+// Whether the client can reconnect to resume its session
+func resumable(cnx ClientCnx) bool {
+	switch c := cnx.(type) {
+	case *SimpleIPCClientCnx:
+		return cjdnserver.HasCapability(c.capabilities, cjdnserver.CapSession)
+	case *AdoptedCnx:
+		return true
+	default:
+		return false
+	}
+}
+
+// Attach a new client connection to the instance of a session and forward its
+// watchdog pings until the connection or the instance is closed
+func handleResume(ctx0 context.Context, c *SimpleIPCClientCnx, payload []byte, clientList *ClientList) error {
+	var msg cjdnserver.ResumeMessage
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		err = cjdnserver.NewError(cjdnserver.ErrCodeProtocol, "Invalid resume request: %v", err)
+		c.SendError(err)
+		return err
+	}
+
+	inst := clientList.FindSession(msg.Session)
+	if inst == nil {
+		err = cjdnserver.NewError(cjdnserver.ErrCodeNotFound, "Unknown session")
+		c.SendError(err)
+		return err
+	}
+
+	inst.Logger().Info("Resume session")
+	inst.Lock()
+	inst.Cnx = c
+	reply := inst.Reply
+	inst.Unlock()
+
+	h := simpleipc.NewHeader(cjdnserver.Resumed, 0, nil)
+	c.wlock.Lock()
+	err = cjdnserver.WriteJSON(c.cnx, h, reply)
+	c.wlock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx0)
+	defer cancel()
+	go func() {
+		select {
+		case <-inst.Done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	receivePings(ctx, inst, c)
+	return nil
+}
+
+func SendTunDev(logger *slog.Logger, sockPath string, tunfd *os.File) (net.Conn, error) {
 	attempts := 0
 	var err error
 	for attempts < 1000 {
@@ -616,6 +1513,7 @@ func SendTunDev(sockPath string, tunfd *os.File) (net.Conn, error) {
 		if err != nil {
 			return nil, err
 		}
+		logger.Debug("Sent tun device", "socket", sockPath, "attempts", attempts+1)
 		return cnx0, nil
 	}
 	return nil, err
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mildred/cjdnserver"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Persisted state of an instance, used to adopt its cjdroute process when the
+// server restarts
+type InstanceState struct {
+	Ino           uint64                   `json:"ino"`
+	Detected      bool                     `json:"detected"`
+	PrivateKey    string                   `json:"privateKey"`
+	Tmpdir        string                   `json:"tmpdir"`
+	SockPath      string                   `json:"sockPath"`
+	AdminAddr     string                   `json:"adminAddr"`
+	AdminPort     int                      `json:"adminPort"`
+	AdminPassword string                   `json:"adminPassword"`
+	Pid           int                      `json:"pid"`
+	PidStartTime  uint64                   `json:"pidStartTime"`
+	Started       time.Time                `json:"started"`
+	Restarts      int                      `json:"restarts"`
+	Reply         *cjdnserver.InitialReply `json:"reply"`
+	Upstream      []Peer                   `json:"upstream"`
+}
+
+func (srv *Server) statePath(ino uint64) string {
+	return path.Join(srv.StateDir, fmt.Sprintf("%d.json", ino))
+}
+
+func (srv *Server) saveState(inst *Instance) {
+	if srv.StateDir == "" {
+		return
+	}
+
+	inst.Lock()
+	st := &InstanceState{
+		Ino:           inst.Ino,
+		Detected:      inst.detected,
+		PrivateKey:    inst.Conf.PrivateKey,
+		Tmpdir:        inst.Tmpdir,
+		SockPath:      inst.SockPath,
+		AdminAddr:     inst.AdminConf.Addr,
+		AdminPort:     inst.AdminConf.Port,
+		AdminPassword: inst.AdminConf.Password,
+		Pid:           inst.Pid,
+		PidStartTime:  inst.pidStartTime,
+		Started:       inst.Started,
+		Restarts:      inst.Restarts,
+		Reply:         inst.Reply,
+		Upstream:      inst.upstream,
+	}
+	inst.Unlock()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(srv.StateDir, 0700)
+	}
+	if err == nil {
+		tmp := srv.statePath(st.Ino) + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, srv.statePath(st.Ino))
+		}
+	}
+	if err != nil {
+		slog.Error("Save instance state", "netns", st.Ino, "err", err)
+	}
+}
+
+func (srv *Server) removeState(inst *Instance) {
+	if srv.StateDir == "" {
+		return
+	}
+	err := os.Remove(srv.statePath(inst.Ino))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Remove instance state", "netns", inst.Ino, "err", err)
+	}
+}
+
+// Adopt the cjdroute processes left running by a previous server and return
+// the detected network namespaces among them
+func (srv *Server) adoptInstances(ctx context.Context, wg *sync.WaitGroup) map[uint64]*DetectedNamespace {
+	nsList := map[uint64]*DetectedNamespace{}
+	if srv.StateDir == "" {
+		return nsList
+	}
+
+	files, err := filepath.Glob(path.Join(srv.StateDir, "*.json"))
+	if err != nil {
+		slog.Error("List instance states", "dir", srv.StateDir, "err", err)
+		return nsList
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			slog.Error("Read instance state", "path", file, "err", err)
+			continue
+		}
+		var st InstanceState
+		err = json.Unmarshal(data, &st)
+		if err != nil {
+			slog.Error("Parse instance state", "path", file, "err", err)
+			continue
+		}
+
+		inst, err := srv.adopt(ctx, wg, &st)
+		if err != nil {
+			slog.Warn("Cannot adopt instance", "netns", st.Ino, "err", err)
+			if st.Tmpdir != "" && strings.HasPrefix(path.Base(st.Tmpdir), "cjdnserver-client") {
+				os.RemoveAll(st.Tmpdir)
+			}
+			os.Remove(file)
+			continue
+		}
+
+		if ns, ok := inst.Cnx.(*DetectedNamespace); ok {
+			nsList[inst.Ino] = ns
+		}
+	}
+
+	return nsList
+}
+
+func (srv *Server) adopt(ctx0 context.Context, wg *sync.WaitGroup, st *InstanceState) (*Instance, error) {
+	startTime, err := GetStartTimeOf(st.Pid)
+	if err != nil || startTime != st.PidStartTime {
+		return nil, fmt.Errorf("cjdroute %d is not running any more", st.Pid)
+	}
+
+	process, err := os.FindProcess(st.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path.Join(st.Tmpdir, "cjdroute.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	tunfd, err := GetTunFdOf(st.Pid)
+	if err != nil {
+		slog.Warn("Cannot restart cjdroute if it stops", "netns", st.Ino, "pid", st.Pid, "err", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx0)
+	inst := &Instance{
+		Ino:       st.Ino,
+		Cancel:    cancel,
+		Done:      make(chan struct{}),
+		Started:   st.Started,
+		Restarts:  st.Restarts,
+		Tmpdir:    st.Tmpdir,
+		SockPath:  st.SockPath,
+		TunFd:     tunfd,
+		Reply:     st.Reply,
+		restart:   make(chan struct{}, 1),
+		ping:      make(chan struct{}),
+		responded: true,
+		detected:  st.Detected,
+		Conf: &Conf{
+			Data:          string(data),
+			IPv6:          st.Reply.IPv6,
+			PublicKey:     st.Reply.PublicKey,
+			PrivateKey:    st.PrivateKey,
+			AdminPassword: st.AdminPassword,
+		},
+		upstream:     st.Upstream,
+		pidStartTime: st.PidStartTime,
+	}
+	if srv.CgroupParent != "" {
+		inst.Cgroup = CgroupPath(srv.CgroupParent, st.Ino)
+		if _, err := os.Stat(inst.Cgroup); err != nil {
+			inst.Cgroup = ""
+		}
+	}
+	inst.Log, err = NewInstanceLog(srv.LogDir, st.Ino, srv.LogMaxSize, srv.LogBackups)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	err = inst.openOutput()
+	if err != nil {
+		inst.Log.Close()
+		cancel()
+		return nil, err
+	}
+	inst.AdminConf.Addr = st.AdminAddr
+	inst.AdminConf.Port = st.AdminPort
+	inst.AdminConf.Password = st.AdminPassword
+	if st.Detected {
+		inst.Cnx = &DetectedNamespace{
+			Ino:      st.Ino,
+			Cancel:   cancel,
+			Watchdog: make(chan struct{}),
+		}
+	} else {
+		inst.Cnx = &AdoptedCnx{}
+	}
+
+	err = srv.Clients.Add(inst)
+	if err != nil {
+		cancel()
+		inst.closeOutput()
+		if tunfd != nil {
+			tunfd.Close()
+		}
+		process.Signal(syscall.SIGTERM)
+		return nil, err
+	}
+
+	inst.Logger().Info("Adopt network namespace")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer srv.cleanup(inst)
+		err := runInstance(ctx, wg, inst, srv, process)
+		if err != nil {
+			inst.Logger().Error("Instance terminated", "err", err)
+		}
+	}()
+	return inst, nil
+}
+
+// Wait for a process that is not a child of the server to terminate, and send
+// a nil state since its exit status cannot be known
+func waitAdopted(ctx context.Context, pid int, startTime uint64, cstate chan *os.ProcessState) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st, err := GetStartTimeOf(pid)
+		if err != nil || st != startTime {
+			cstate <- nil
+			return
+		}
+	}
+}
+
+// Client connection of an adopted instance. The connection to the client was
+// lost with the previous server, the instance stops when the watchdog expires
+// unless the client resumes its session.
+type AdoptedCnx struct{}
+
+func (c *AdoptedCnx) ReceiveRequest() (*ClientRequest, error) {
+	return nil, fmt.Errorf("Adopted instance cannot receive requests")
+}
+
+func (c *AdoptedCnx) SendInitialResponse(reply *cjdnserver.InitialReply) error {
+	return nil
+}
+
+func (c *AdoptedCnx) SendError(err error) error {
+	return nil
+}
+
+func (c *AdoptedCnx) SendEvent(ev *cjdnserver.EventMessage) error {
+	return nil
+}
+
+func (c *AdoptedCnx) ReceivePing(ctx context.Context) (error, bool) {
+	<-ctx.Done()
+	return nil, false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fc00/go-cjdns/admin"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Deadlines of each step of the cjdroute shutdown: Core_exit through the admin
+// interface, then SIGTERM, then SIGKILL. A zero ExitTimeout or TermTimeout
+// skips the step.
+type StopPolicy struct {
+	ExitTimeout time.Duration
+	TermTimeout time.Duration
+	KillTimeout time.Duration
+}
+
+func (p *StopPolicy) Validate() error {
+	if p.ExitTimeout < 0 || p.TermTimeout < 0 || p.KillTimeout <= 0 {
+		return fmt.Errorf("invalid stop timeouts %v, %v, %v", p.ExitTimeout, p.TermTimeout, p.KillTimeout)
+	}
+	return nil
+}
+
+// Stop cjdroute, escalating from Core_exit to SIGTERM and SIGKILL when it does
+// not terminate in time. Return an error if cjdroute is still running after
+// SIGKILL.
+func stopProcess(logger *slog.Logger, policy *StopPolicy, adminConf *admin.CjdnsAdminConfig, process *os.Process, cstate chan *os.ProcessState, cerr chan error) error {
+	if policy.ExitTimeout > 0 {
+		logger.Info("Send Core_exit()")
+		exitErr := make(chan error, 1)
+		go func() {
+			adm, err := admin.Connect(adminConf)
+			if err != nil {
+				exitErr <- fmt.Errorf("connect to admin interface: %v", err)
+				return
+			}
+			exitErr <- adm.Core_exit()
+		}()
+		if waitProcess(logger, policy.ExitTimeout, exitErr, cstate, cerr) {
+			return nil
+		}
+	}
+
+	if policy.TermTimeout > 0 {
+		logger.Info("Send SIGTERM to cjdroute")
+		process.Signal(syscall.SIGTERM)
+		if waitProcess(logger, policy.TermTimeout, nil, cstate, cerr) {
+			return nil
+		}
+	}
+
+	logger.Warn("Send SIGKILL to cjdroute")
+	process.Signal(syscall.SIGKILL)
+	if waitProcess(logger, policy.KillTimeout, nil, cstate, cerr) {
+		return nil
+	}
+	return fmt.Errorf("cjdroute %d still running after SIGKILL", process.Pid)
+}
+
+// Wait for cjdroute to terminate within the timeout. Stop waiting early when
+// the request to terminate fails (an error on stepErr).
+func waitProcess(logger *slog.Logger, timeout time.Duration, stepErr chan error, cstate chan *os.ProcessState, cerr chan error) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-cerr:
+			logger.Error("cjdroute failed", "err", err)
+			return true
+		case state := <-cstate:
+			if state == nil {
+				logger.Info("cjdroute terminated")
+			} else {
+				logger.Info("cjdroute terminated", "state", state.String())
+			}
+			return true
+		case err := <-stepErr:
+			if err != nil {
+				logger.Warn("Core_exit", "err", err)
+				return false
+			}
+			stepErr = nil
+		case <-timer.C:
+			logger.Warn("cjdroute did not terminate", "timeout", timeout)
+			return false
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// First file descriptor passed by systemd socket activation
+	SdListenFdsStart = 3
+	// Names of the activated sockets (FileDescriptorName= in the socket unit)
+	SdClientSocket  = "cjdnserver"
+	SdControlSocket = "control"
+)
+
+// Return the listeners passed by systemd socket activation by name, "unknown"
+// for the sockets without a name. The environment variables are unset so the
+// children do not inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := map[string]net.Listener{}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < nfds; i++ {
+		fd := SdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("activated socket %s: %v", name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// Take the activated listener with the given name or bound to the given path,
+// nil if there is none
+func takeListener(listeners map[string]net.Listener, name, sockPath string) net.Listener {
+	for n, l := range listeners {
+		if n == name || (sockPath != "" && l.Addr().String() == sockPath) {
+			delete(listeners, n)
+			slog.Info("Use activated socket", "name", n, "addr", l.Addr().String())
+			return l
+		}
+	}
+	return nil
+}
+
+// Notifications to the service manager through NOTIFY_SOCKET
+type Notifier struct {
+	addr *net.UnixAddr
+	// Interval of the WATCHDOG=1 keepalives, 0 if the watchdog is disabled
+	Watchdog time.Duration
+}
+
+// Return a notifier if the server is run by systemd with Type=notify, nil
+// otherwise. The environment variables are unset so the children do not
+// inherit them.
+func NewNotifier() *Notifier {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	wpid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	if err == nil && wpid != os.Getpid() {
+		usec = 0
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if sock == "" {
+		return nil
+	}
+
+	if sock[0] == '@' {
+		// abstract socket
+		sock = "\x00" + sock[1:]
+	}
+	return &Notifier{
+		addr:     &net.UnixAddr{Name: sock, Net: "unixgram"},
+		Watchdog: time.Duration(usec) * time.Microsecond / 2,
+	}
+}
+
+// Send the state lines, does nothing without a service manager
+func (n *Notifier) Notify(state ...string) error {
+	if n == nil {
+		return nil
+	}
+	cnx, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer cnx.Close()
+	_, err = cnx.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+func statusLine(clients *ClientList) string {
+	n := len(clients.List())
+	if n == 1 {
+		return "STATUS=Serving 1 instance"
+	}
+	return fmt.Sprintf("STATUS=Serving %d instances", n)
+}
+
+// Report that the server is ready, then keep the status up to date with the
+// number of instances and send the watchdog keepalives until the context is
+// cancelled
+func (n *Notifier) Run(ctx context.Context, clients *ClientList) {
+	if n == nil {
+		return
+	}
+	err := n.Notify("READY=1", statusLine(clients))
+	if err != nil {
+		slog.Warn("Notify service manager", "err", err)
+	}
+
+	var keepalive <-chan time.Time
+	if n.Watchdog > 0 {
+		ticker := time.NewTicker(n.Watchdog)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			n.Notify("STOPPING=1")
+			return
+		case <-keepalive:
+			err = n.Notify("WATCHDOG=1")
+		case <-clients.Changed:
+			err = n.Notify(statusLine(clients))
+		}
+		if err != nil {
+			slog.Warn("Notify service manager", "err", err)
+		}
+	}
+}
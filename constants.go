@@ -4,4 +4,76 @@ const (
 	InitialRequest  = 0
 	InitialResponse = 1
 	WatchdogPing    = 2
+	Hello           = 3
+	HelloResponse   = 4
+	ErrorResponse   = 5
+	Release         = 6
+	Released        = 7
+	Event           = 8
+	Subscribe       = 9
+	Resume          = 10
+	Resumed         = 11
+	Health          = 12
+	HealthResponse  = 13
 )
+
+const (
+	// Version of the protocol implemented by this package. Clients that do not
+	// start with a Hello message are assumed to speak version 0.
+	ProtocolVersion = 1
+
+	// Oldest protocol version the server is still able to serve
+	MinProtocolVersion = 0
+)
+
+const (
+	// The client can send its private key along with the initial request
+	CapPrivKey = "privkey"
+
+	// The client understands ErrorResponse messages
+	CapErrors = "errors"
+
+	// The server sends interface details in the InitialResponse payload
+	CapInterfaceInfo = "interface-info"
+
+	// The InitialRequest payload is a JSON object with interface options instead
+	// of a raw private key
+	CapOptions = "options"
+
+	// The client can release its instance with a Release message
+	CapRelease = "release"
+
+	// The client receives Event messages and can subscribe to them
+	CapEvents = "events"
+
+	// The client can resume its session on a new connection
+	CapSession = "session"
+
+	// The client can ask the server to hold the InitialResponse until the
+	// instance is connected to the network
+	CapWaitConnected = "wait-connected"
+
+	// The client can query the health of its instance with a Health message
+	CapHealth = "health"
+
+	// The client can propose its watchdog ping interval and timeout
+	CapWatchdog = "watchdog"
+
+	// The client can request resource limits for its cjdroute instance
+	CapLimits = "limits"
+)
+
+// Capabilities implemented by this package
+var Capabilities = []string{
+	CapPrivKey,
+	CapErrors,
+	CapInterfaceInfo,
+	CapOptions,
+	CapRelease,
+	CapEvents,
+	CapSession,
+	CapWaitConnected,
+	CapHealth,
+	CapWatchdog,
+	CapLimits,
+}
@@ -0,0 +1,47 @@
+package cjdnserver
+
+import (
+	"fmt"
+)
+
+// Error codes sent in ErrorResponse messages
+const (
+	ErrCodeInternal           = "internal"
+	ErrCodeProtocol           = "protocol"
+	ErrCodeDuplicateNamespace = "duplicate-namespace"
+	ErrCodeTunDevice          = "tun-device"
+	ErrCodeCjdrouteMissing    = "cjdroute-missing"
+	ErrCodeQuotaExceeded      = "quota-exceeded"
+	ErrCodeNotFound           = "not-found"
+	ErrCodeNotConnected       = "not-connected"
+)
+
+// Payload of the ErrorResponse message, sent by the server when it cannot
+// serve the client
+type Error struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func NewError(code string, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// Convert any error to an *Error, errors that are not already of that type are
+// given the code ErrCodeInternal
+func AsError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{
+		Code:   ErrCodeInternal,
+		Reason: err.Error(),
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Reason, e.Code)
+}
@@ -0,0 +1,191 @@
+package cjdnserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mildred/simpleipc"
+	"net"
+	"strings"
+	"time"
+)
+
+// Payload of the Hello message, sent by the client as the first message
+type HelloMessage struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Capabilities the client cannot work without
+	Require []string `json:"require,omitempty"`
+}
+
+// Payload of the HelloResponse message. If Error is set, the server refused
+// the client and closes the connection.
+type HelloReply struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Negotiate the protocol version and capabilities common to the client hello
+// and the server
+func Negotiate(hello *HelloMessage, serverCaps []string) *HelloReply {
+	reply := &HelloReply{
+		Version: hello.Version,
+	}
+	if reply.Version > ProtocolVersion {
+		reply.Version = ProtocolVersion
+	}
+	if reply.Version < MinProtocolVersion {
+		reply.Error = fmt.Sprintf("protocol version %d is not supported, server needs at least version %d", hello.Version, MinProtocolVersion)
+		return reply
+	}
+
+	for _, c := range hello.Capabilities {
+		if HasCapability(serverCaps, c) {
+			reply.Capabilities = append(reply.Capabilities, c)
+		}
+	}
+
+	var missing []string
+	for _, c := range hello.Require {
+		if !HasCapability(serverCaps, c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		reply.Error = fmt.Sprintf("server does not support required capabilities: %s", strings.Join(missing, ", "))
+	}
+	return reply
+}
+
+func HasCapability(caps []string, c string) bool {
+	for _, cap := range caps {
+		if cap == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload of the InitialRequest message when the options capability is
+// negotiated. All fields are optional, the server validates them against its
+// policy.
+type InitialMessage struct {
+	PrivateKey string        `json:"privateKey,omitempty"`
+	Interface  string        `json:"interface,omitempty"`
+	MTU        int           `json:"mtu,omitempty"`
+	Routes     []string      `json:"routes,omitempty"`
+	Peers      []PeerOptions `json:"peers,omitempty"`
+	// Hold the InitialResponse until a peer session is established, or until
+	// WaitTarget answers to pings if set. WaitTimeout is in seconds.
+	WaitConnected bool   `json:"waitConnected,omitempty"`
+	WaitTarget    string `json:"waitTarget,omitempty"`
+	WaitTimeout   int    `json:"waitTimeout,omitempty"`
+	// Proposed interval between watchdog pings and time without pings after
+	// which the instance is stopped, in seconds
+	WatchdogInterval int `json:"watchdogInterval,omitempty"`
+	WatchdogTimeout  int `json:"watchdogTimeout,omitempty"`
+	// Resource limits for cjdroute, lower than the server limits
+	Limits *ResourceLimits `json:"limits,omitempty"`
+}
+
+// Resource limits applied to a cjdroute instance, zero values are unlimited
+type ResourceLimits struct {
+	// Memory in bytes
+	MemoryMax int64 `json:"memoryMax,omitempty"`
+	// Number of CPUs, can be fractional
+	CPUMax  float64 `json:"cpuMax,omitempty"`
+	PidsMax int     `json:"pidsMax,omitempty"`
+}
+
+// Additional peer requested by the client
+type PeerOptions struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+	Password  string `json:"password,omitempty"`
+}
+
+// Payload of the InitialResponse message, describing the interface created in
+// the client network namespace
+type InitialReply struct {
+	IPv6      string     `json:"ipv6"`
+	PublicKey string     `json:"publicKey"`
+	Interface string     `json:"interface"`
+	PrefixLen int        `json:"prefixLen"`
+	MTU       int        `json:"mtu"`
+	Routes    []string   `json:"routes,omitempty"`
+	Peers     []PeerInfo `json:"peers,omitempty"`
+	// Options from the InitialMessage accepted by the server, and reasons for
+	// the rejected ones
+	Accepted []string `json:"accepted,omitempty"`
+	Rejected []string `json:"rejected,omitempty"`
+	// Token to resume the session on a new connection
+	Session string `json:"session,omitempty"`
+	// The instance was connected to the network when the response was sent
+	Connected bool `json:"connected,omitempty"`
+	// Watchdog ping interval and timeout agreed by the server, in seconds
+	WatchdogInterval int `json:"watchdogInterval,omitempty"`
+	WatchdogTimeout  int `json:"watchdogTimeout,omitempty"`
+}
+
+// Payload of the Resume message, sent by the client on a new connection to
+// attach it to an existing instance. The server answers with a Resumed message
+// with an InitialReply payload.
+type ResumeMessage struct {
+	Session string `json:"session"`
+}
+
+// Upstream peer the cjdns instance connects to
+type PeerInfo struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+}
+
+// Event types
+const (
+	EventRestarted    = "restarted"
+	EventPeerUp       = "peer-up"
+	EventPeerDown     = "peer-down"
+	EventShuttingDown = "shutting-down"
+	// cjdroute keeps failing and the server stopped restarting it
+	EventFailed = "failed"
+)
+
+// Payload of the Event message, pushed by the server when something happens to
+// the instance
+type EventMessage struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	IPv6 string    `json:"ipv6,omitempty"`
+	// Public key of the peer for peer events
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Payload of the HealthResponse message, describing the instance of the
+// network namespace sent with the Health message. State is one of starting,
+// running, restarting or failed.
+type HealthReply struct {
+	// Healthy when cjdroute is running and at least one peer session is
+	// established, if peers are configured
+	Healthy  bool   `json:"healthy"`
+	Running  bool   `json:"running"`
+	State    string `json:"state"`
+	Pid      int    `json:"pid"`
+	IPv6     string `json:"ipv6"`
+	Restarts int    `json:"restarts"`
+	// Number of peers of the instance and how many have an established session
+	Peers       int `json:"peers"`
+	Established int `json:"established"`
+	// Last watchdog ping received from the client, zero if none
+	LastPing time.Time `json:"lastPing"`
+}
+
+// Write a message with a JSON payload
+func WriteJSON(cnx *net.UnixConn, h *simpleipc.Header, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.Size = uint32(len(data))
+	return h.WriteWithPayload(cnx, data)
+}
@@ -0,0 +1,68 @@
+package cjdnserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		client  int
+		version int
+		refused bool
+	}{
+		{ProtocolVersion + 5, ProtocolVersion, false},
+		{ProtocolVersion, ProtocolVersion, false},
+		{MinProtocolVersion, MinProtocolVersion, false},
+		{MinProtocolVersion - 1, MinProtocolVersion - 1, true},
+	}
+	for _, test := range tests {
+		reply := Negotiate(&HelloMessage{Version: test.client}, Capabilities)
+		if reply.Version != test.version {
+			t.Errorf("client version %d: negotiated %d, expected %d", test.client, reply.Version, test.version)
+		}
+		if refused := reply.Error != ""; refused != test.refused {
+			t.Errorf("client version %d: refused %v, expected %v (%s)", test.client, refused, test.refused, reply.Error)
+		}
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	server := []string{"options", "events", "health"}
+	reply := Negotiate(&HelloMessage{
+		Version:      ProtocolVersion,
+		Capabilities: []string{"events", "future", "options"},
+	}, server)
+	if reply.Error != "" {
+		t.Fatalf("refused: %s", reply.Error)
+	}
+	if !reflect.DeepEqual(reply.Capabilities, []string{"events", "options"}) {
+		t.Errorf("capabilities %v, expected [events options]", reply.Capabilities)
+	}
+
+	reply = Negotiate(&HelloMessage{Version: ProtocolVersion}, server)
+	if reply.Error != "" || len(reply.Capabilities) != 0 {
+		t.Errorf("without capabilities: %#v", reply)
+	}
+}
+
+func TestNegotiateRequire(t *testing.T) {
+	server := []string{"options", "events"}
+	reply := Negotiate(&HelloMessage{
+		Version:      ProtocolVersion,
+		Capabilities: []string{"options", "events", "limits"},
+		Require:      []string{"options", "limits", "health"},
+	}, server)
+	expected := "server does not support required capabilities: limits, health"
+	if reply.Error != expected {
+		t.Errorf("error %#v, expected %#v", reply.Error, expected)
+	}
+
+	reply = Negotiate(&HelloMessage{
+		Version: ProtocolVersion,
+		Require: []string{"events"},
+	}, server)
+	if reply.Error != "" {
+		t.Errorf("refused with supported requirements: %s", reply.Error)
+	}
+}
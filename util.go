@@ -6,8 +6,30 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 )
 
+// Wait for the wait group to complete, return false if the timeout expires
+// first
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Cancel the context on the first of the signals. The signals then get their
+// default behaviour back so a second one terminates the process without
+// waiting for a clean shutdown.
 func CancelSignals(ctx context.Context, wg *sync.WaitGroup, cancelContext context.CancelFunc, signals ...os.Signal) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, signals...)